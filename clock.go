@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// A clock tells an Entity what time it is. Tests use a fakeClock to move
+// time by hand.
+type clock interface {
+	now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) now() time.Time {
+	return time.Now()
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// timeOn is the time on c, or on the system clock when there is none.
+func timeOn(c clock) time.Time {
+	if c == nil {
+		return systemClock{}.now()
+	}
+	return c.now()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: [-trace file] [-curve ed448|x448] [command [args]]")
+	fmt.Fprintln(os.Stderr, "  (no command)                     run the built-in scenarios of the design")
+	fmt.Fprintln(os.Stderr, "  scenario [-seed s] [-transcript f] [-count] file...")
+	fmt.Fprintln(os.Stderr, "                                   run scenario files against the design; a seed")
+	fmt.Fprintln(os.Stderr, "                                   makes the run reproducible, over X448 whatever -curve is")
+	fmt.Fprintln(os.Stderr, "  vectors [-generate] [-dir d] [scenario...]")
+	fmt.Fprintln(os.Stderr, "                                   check (or write) the KDF and transcript vectors")
+	fmt.Fprintln(os.Stderr, "  prekey-server [-addr a] [-low n]  serve prekey messages over HTTP on localhost")
+	fmt.Fprintln(os.Stderr, "  diagram [-format f] trace.jsonl  draw a recorded trace (mermaid or plantuml)")
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	exit(1)
+}
+
+// traceFile is where -trace writes, if set.
+var traceFile *os.File
+
+// closeTrace closes the -trace file. A design defers it in main, as its
+// built-in scenarios also trace into it.
+func closeTrace() {
+	if traceFile != nil {
+		traceFile.Close()
+		traceFile = nil
+	}
+}
+
+// exit ends the run with code, once the -trace file is closed.
+func exit(code int) {
+	closeTrace()
+	os.Exit(code)
+}
+
+// runCommand handles the command line of a design. It returns false when
+// there is no command and the design should run its built-in scenarios.
+func runCommand(args []string) bool {
+	fs := flag.NewFlagSet("design", flag.ExitOnError)
+	fs.Usage = usage
+	tracePath := fs.String("trace", "", "also write a JSON trace of the run to this file")
+	curveName := fs.String("curve", "ed448", "DH of the ratchet: ed448, or x448 which validates points")
+	fs.Parse(args)
+
+	switch *curveName {
+	case "ed448":
+	case "x448":
+		defaultCurve = x448Curve{}
+	default:
+		usage()
+		exit(2)
+	}
+
+	if *tracePath != "" {
+		f, err := os.Create(*tracePath)
+		if err != nil {
+			fail(err)
+		}
+		traceFile = f
+		defaultTracer = multiTracer{defaultTracer, jsonTracer{f}}
+	}
+
+	if fs.Arg(0) == "" {
+		return false
+	}
+	defer closeTrace()
+
+	switch fs.Arg(0) {
+	case "scenario":
+		runScenarios(fs.Args()[1:])
+	case "vectors":
+		runVectors(fs.Args()[1:])
+	case "diagram":
+		runDiagram(fs.Args()[1:])
+	case "prekey-server":
+		runPrekeyServer(fs.Args()[1:])
+	default:
+		usage()
+		exit(2)
+	}
+	return true
+}
+
+func runDiagram(args []string) {
+	fs := flag.NewFlagSet("diagram", flag.ExitOnError)
+	format := fs.String("format", "mermaid", "mermaid or plantuml")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+
+	events, err := readTrace(f)
+	if err != nil {
+		fail(err)
+	}
+
+	diagram, err := sequenceDiagram(events, *format)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Print(diagram)
+}
+
+func runPrekeyServer(args []string) {
+	fs := flag.NewFlagSet("prekey-server", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8448", "address to listen on")
+	lowWatermark := fs.Int("low", 5, "report identities with fewer prekey messages left than this")
+	fs.Parse(args)
+
+	server := newPrekeyServer(*lowWatermark)
+	server.notifyLow = func(identity string, instanceTag uint32, left int) {
+		fmt.Printf("%s (instance %08x) is running low: %d prekey messages left\n", identity, instanceTag, left)
+	}
+
+	l, err := listenPrekeyServer(server, *addr)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("serving prekeys on http://%s\n", l.Addr())
+	select {}
+}
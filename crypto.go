@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/sha3"
+)
+
+// A provider is every primitive an Entity uses: its curve for keys and DH,
+// the KDF, the AEAD of the payloads and the signatures of the identity key.
+// Swapping it lets us try other algorithms, or count what a design costs.
+type provider interface {
+	curve
+	kdf(out, in []byte)
+	seal(k key, plaintext []byte) []byte
+	open(k key, ciphertext []byte) ([]byte, error)
+	generateSigningKeys() (seckey, pubkey)
+	sign(priv seckey, message []byte) [112]byte
+	verify(sig [112]byte, message []byte, pub pubkey) bool
+}
+
+// standardProvider is what the designs have always used: SHAKE-256 and ed448
+// signatures, plus ChaCha20-Poly1305 for the payloads.
+type standardProvider struct {
+	curve
+}
+
+// defaultProvider is the provider of every Entity which has not been given
+// its own. It follows defaultCurve.
+func defaultProvider() provider {
+	return standardProvider{defaultCurve}
+}
+
+func (standardProvider) kdf(out, in []byte) {
+	sha3.ShakeSum256(out, in)
+}
+
+// seal uses a zero nonce, since a message key encrypts a single message.
+func (standardProvider) seal(k key, plaintext []byte) []byte {
+	aead, err := chacha20poly1305.New(k[:chacha20poly1305.KeySize])
+	if err != nil {
+		panic("failed to encrypt message.")
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, nil)
+}
+
+func (standardProvider) open(k key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(k[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, nil)
+}
+
+func (standardProvider) generateSigningKeys() (seckey, pubkey) {
+	priv, pub, ok := identityCurve.GenerateKeys()
+	if !ok {
+		panic("failed to generate keys.")
+	}
+	return priv, pub
+}
+
+func (standardProvider) sign(priv seckey, message []byte) [112]byte {
+	sig, ok := identityCurve.Sign(priv, message)
+	if !ok {
+		panic("failed to sign.")
+	}
+	return sig
+}
+
+func (standardProvider) verify(sig [112]byte, message []byte, pub pubkey) bool {
+	return identityCurve.Verify(sig, message, pub)
+}
+
+var operationNames = []string{"keygen", "dh", "kdf", "seal", "open", "sign", "verify"}
+
+// countingProvider counts the operations of the provider it wraps, to
+// compare what the designs cost.
+type countingProvider struct {
+	provider
+	counts map[string]int
+}
+
+func newCountingProvider(p provider) *countingProvider {
+	return &countingProvider{p, make(map[string]int)}
+}
+
+func (c *countingProvider) generateKeys(r io.Reader) (seckey, pubkey) {
+	c.counts["keygen"]++
+	return c.provider.generateKeys(r)
+}
+
+func (c *countingProvider) computeSecret(priv seckey, pub pubkey) ([64]byte, error) {
+	c.counts["dh"]++
+	return c.provider.computeSecret(priv, pub)
+}
+
+func (c *countingProvider) kdf(out, in []byte) {
+	c.counts["kdf"]++
+	c.provider.kdf(out, in)
+}
+
+func (c *countingProvider) seal(k key, plaintext []byte) []byte {
+	c.counts["seal"]++
+	return c.provider.seal(k, plaintext)
+}
+
+func (c *countingProvider) open(k key, ciphertext []byte) ([]byte, error) {
+	c.counts["open"]++
+	return c.provider.open(k, ciphertext)
+}
+
+func (c *countingProvider) generateSigningKeys() (seckey, pubkey) {
+	c.counts["keygen"]++
+	return c.provider.generateSigningKeys()
+}
+
+func (c *countingProvider) sign(priv seckey, message []byte) [112]byte {
+	c.counts["sign"]++
+	return c.provider.sign(priv, message)
+}
+
+func (c *countingProvider) verify(sig [112]byte, message []byte, pub pubkey) bool {
+	c.counts["verify"]++
+	return c.provider.verify(sig, message, pub)
+}
+
+func (c *countingProvider) String() string {
+	var ops []string
+	for _, name := range operationNames {
+		ops = append(ops, fmt.Sprintf("%s %d", name, c.counts[name]))
+	}
+	return strings.Join(ops, ", ")
+}
+
+func (e *Entity) provider() provider {
+	if e.crypto == nil {
+		return defaultProvider()
+	}
+	return e.crypto
+}
+
+// wipeKeys overwrites keys we are done with.
+func wipeKeys(keys ...[]byte) {
+	for _, k := range keys {
+		for i := range k {
+			k[i] = 0
+		}
+	}
+}
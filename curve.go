@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/twstrike/ed448"
+)
+
+// A curve is the DH group the ratchet runs on. Keys are drawn from the random
+// source of the Entity, so a curve which honours it gives reproducible runs.
+// validate, and so computeSecret, fail on public keys a peer should never
+// have sent.
+type curve interface {
+	generateKeys(r io.Reader) (seckey, pubkey)
+	computeSecret(priv seckey, pub pubkey) ([64]byte, error)
+	validate(pub pubkey) error
+}
+
+var (
+	errInvalidPoint = errors.New("invalid point")
+	errSmallOrder   = errors.New("small order point")
+)
+
+var defaultCurve curve = ed448Curve{ed448.NewCurve()}
+
+// ed448Curve always draws from crypto/rand, since twstrike/ed448 does not let
+// us give it a random source. twstrike/ed448 does not validate points either:
+// only an all zero key is rejected here. Use x448Curve against hostile peers.
+type ed448Curve struct {
+	ed448.Curve
+}
+
+func (c ed448Curve) generateKeys(r io.Reader) (seckey, pubkey) {
+	priv, pub, ok := c.GenerateKeys()
+	if !ok {
+		panic("failed to generate keys.")
+	}
+	return priv, pub
+}
+
+func (c ed448Curve) computeSecret(priv seckey, pub pubkey) ([64]byte, error) {
+	if err := c.validate(pub); err != nil {
+		return [64]byte{}, err
+	}
+	return c.ComputeSecret(priv, pub), nil
+}
+
+func (ed448Curve) validate(pub pubkey) error {
+	if pub == (pubkey{}) {
+		return errInvalidPoint
+	}
+	return nil
+}
+
+// x448Curve is X448 from RFC 7748. The scalar lives in the first 56 bytes of
+// a seckey. It is not constant time: this is a reference design.
+type x448Curve struct{}
+
+var (
+	x448P   = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 448), new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 224), big.NewInt(1)))
+	x448A   = big.NewInt(156326)
+	x448A24 = big.NewInt(39081)
+	x448U   = pubkey{5}
+)
+
+func (x448Curve) generateKeys(r io.Reader) (priv seckey, pub pubkey) {
+	if _, err := io.ReadFull(r, priv[:56]); err != nil {
+		panic("failed to generate keys.")
+	}
+	copy(pub[:], x448(priv[:56], x448U[:]))
+	return
+}
+
+func (x448Curve) computeSecret(priv seckey, pub pubkey) ([64]byte, error) {
+	var secret [64]byte
+	if err := x448Validate(pub[:]); err != nil {
+		return secret, err
+	}
+
+	shared := x448(priv[:56], pub[:])
+	if new(big.Int).SetBytes(shared).Sign() == 0 {
+		return secret, errSmallOrder
+	}
+	sha3.ShakeSum256(secret[:], shared)
+	return secret, nil
+}
+
+func (x448Curve) validate(pub pubkey) error {
+	return x448Validate(pub[:])
+}
+
+// x448Validate rejects a u-coordinate which is not canonical, which has a
+// small order (the identity maps to 0) or which is on the twist rather than
+// on the curve. The all zero check of RFC 7748 on the shared secret would
+// catch small orders too, but we want to say why.
+func x448Validate(u []byte) error {
+	n := littleEndian(u)
+	if n.Cmp(x448P) >= 0 {
+		return errInvalidPoint
+	}
+
+	pMinus1 := new(big.Int).Sub(x448P, big.NewInt(1))
+	if n.Sign() == 0 || n.Cmp(big.NewInt(1)) == 0 || n.Cmp(pMinus1) == 0 {
+		return errSmallOrder
+	}
+
+	// v^2 = u^3 + A*u^2 + u must have a solution
+	u2 := new(big.Int).Mul(n, n)
+	rhs := new(big.Int).Mul(u2, n)
+	rhs.Add(rhs, new(big.Int).Mul(x448A, u2))
+	rhs.Add(rhs, n)
+	rhs.Mod(rhs, x448P)
+	if big.Jacobi(rhs, x448P) != 1 {
+		return errInvalidPoint
+	}
+	return nil
+}
+
+func littleEndian(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+func x448(scalar, u []byte) []byte {
+	k := make([]byte, 56)
+	copy(k, scalar)
+	k[0] &= 252
+	k[55] |= 128
+
+	p := x448P
+	mul := func(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Mul(a, b), p) }
+	add := func(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Add(a, b), p) }
+	sub := func(a, b *big.Int) *big.Int { return new(big.Int).Mod(new(big.Int).Sub(a, b), p) }
+
+	x1 := new(big.Int).Mod(littleEndian(u), p)
+	x2, z2 := big.NewInt(1), big.NewInt(0)
+	x3, z3 := new(big.Int).Set(x1), big.NewInt(1)
+
+	swap := uint(0)
+	for t := 447; t >= 0; t-- {
+		kt := uint(k[t/8]>>uint(t%8)) & 1
+		if swap^kt == 1 {
+			x2, x3 = x3, x2
+			z2, z3 = z3, z2
+		}
+		swap = kt
+
+		a := add(x2, z2)
+		aa := mul(a, a)
+		b := sub(x2, z2)
+		bb := mul(b, b)
+		e := sub(aa, bb)
+		c := add(x3, z3)
+		d := sub(x3, z3)
+		da := mul(d, a)
+		cb := mul(c, b)
+		x3 = mul(add(da, cb), add(da, cb))
+		z3 = mul(x1, mul(sub(da, cb), sub(da, cb)))
+		x2 = mul(aa, bb)
+		z2 = mul(e, add(aa, mul(x448A24, e)))
+	}
+	if swap == 1 {
+		x2, z2 = x3, z3
+	}
+
+	inv := new(big.Int).Exp(z2, new(big.Int).Sub(p, big.NewInt(2)), p)
+	be := mul(x2, inv).FillBytes(make([]byte, 56))
+	out := make([]byte, 56)
+	for i := range be {
+		out[55-i] = be[i]
+	}
+	return out
+}
+
+// seededRand is a SHAKE-256 stream: the same seed and name always give the
+// same bytes.
+func seededRand(seed []byte, name string) io.Reader {
+	h := sha3.NewShake256()
+	h.Write(seed)
+	h.Write([]byte(name))
+	return h
+}
+
+func (e *Entity) randReader() io.Reader {
+	if e.rand == nil {
+		return rand.Reader
+	}
+	return e.rand
+}
+
+func (e *Entity) generateKeys() (seckey, pubkey) {
+	return e.provider().generateKeys(e.randReader())
+}
+
+// computeSecret is the DH of priv and pub on the curve of e. It fails when
+// the peer sent a public key it should never have.
+func (e *Entity) computeSecret(priv seckey, pub pubkey) ([64]byte, error) {
+	return e.provider().computeSecret(priv, pub)
+}
+
+// mustComputeSecret panics instead, like a failed decryption, for the
+// designs which have no way to reject a message.
+func (e *Entity) mustComputeSecret(priv seckey, pub pubkey) [64]byte {
+	secret, err := e.computeSecret(priv, pub)
+	if err != nil {
+		panic(err.Error())
+	}
+	return secret
+}
+
+// initializeSeeded is initialize for reproducible runs: both entities use
+// X448 with keys drawn from streams derived from the seed. The ed448 curve
+// draws its keys from crypto/rand whatever reader it is given, so seeded
+// runs never use it, even when -curve asks for it.
+func initializeSeeded(seed []byte) (alice, bob *Entity) {
+	alice, bob = initialize()
+	alice.rand, alice.crypto = seededRand(seed, alice.name), standardProvider{x448Curve{}}
+	bob.rand, bob.crypto = seededRand(seed, bob.name), standardProvider{x448Curve{}}
+	return
+}
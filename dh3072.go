@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/big"
+)
+
+// The 3072-bit MODP group of RFC 3526, which OTRv4 mixes into the ratchet
+// every third ratchet.
+var (
+	dh3072P, _ = new(big.Int).SetString(""+
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D"+
+		"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F"+
+		"83655D23DCA3AD961C62F356208552BB9ED529077096966D"+
+		"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9"+
+		"DE2BCBF6955817183995497CEA956AE515D2261898FA0510"+
+		"15728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64"+
+		"ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7"+
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6B"+
+		"F12FFA06D98A0864D87602733EC86A64521F2B18177B200C"+
+		"BBE117577A615D6C770988C0BAD946E208E24FA074E5AB31"+
+		"43DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF", 16)
+	dh3072G = big.NewInt(2)
+	dh3072Q = new(big.Int).Rsh(dh3072P, 1) // (p - 1) / 2
+)
+
+var errBadDH3072 = errors.New("invalid 3072-bit DH value")
+
+// generateDH3072 draws an 80 byte exponent, as OTRv4 does.
+func generateDH3072(r io.Reader) (priv, pub *big.Int) {
+	b := make([]byte, 80)
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic("failed to generate keys.")
+	}
+	priv = new(big.Int).SetBytes(b)
+	return priv, new(big.Int).Exp(dh3072G, priv, dh3072P)
+}
+
+// dh3072Check rejects values outside of the subgroup of order q.
+func dh3072Check(pub *big.Int) error {
+	two := big.NewInt(2)
+	if pub == nil || pub.Cmp(two) < 0 || pub.Cmp(new(big.Int).Sub(dh3072P, two)) > 0 {
+		return errBadDH3072
+	}
+	if new(big.Int).Exp(pub, dh3072Q, dh3072P).Cmp(big.NewInt(1)) != 0 {
+		return errBadDH3072
+	}
+	return nil
+}
+
+func dh3072Secret(priv, pub *big.Int) ([]byte, error) {
+	if err := dh3072Check(pub); err != nil {
+		return nil, err
+	}
+	return new(big.Int).Exp(pub, priv, dh3072P).FillBytes(make([]byte, 384)), nil
+}
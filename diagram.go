@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type diagramSyntax struct {
+	header, footer string
+	participant    string
+	arrow          string // a message delivered as soon as it is sent
+	lateArrow      string // a message delivered after other traffic
+	note           string
+}
+
+var diagramSyntaxes = map[string]diagramSyntax{
+	"mermaid": {
+		header:      "sequenceDiagram\n",
+		participant: "    participant %s\n",
+		arrow:       "    %s->>%s: %s\n",
+		lateArrow:   "    %s--)%s: %s\n",
+		note:        "    Note over %s: %s\n",
+	},
+	"plantuml": {
+		header:      "@startuml\n",
+		footer:      "@enduml\n",
+		participant: "participant %s\n",
+		arrow:       "%s -> %s : %s\n",
+		lateArrow:   "%s -->> %s : %s\n",
+		note:        "note over %s : %s\n",
+	},
+}
+
+func msgLabel(ev event) string {
+	switch ev.mtype {
+	case D:
+		return fmt.Sprintf("D(%d,%d,%d)", ev.ssid, ev.rid, ev.mid)
+	case P1, P2:
+		return fmt.Sprintf("%s(%d)", msgTypeNames[ev.mtype], ev.ssid)
+	}
+	return msgTypeNames[ev.mtype]
+}
+
+// deliveries pairs every send event with the receive event of the same
+// message, if there is one. Equal messages are delivered in order.
+func deliveries(events []event) map[int]int {
+	type msgID struct {
+		sender         string
+		mtype          int
+		ssid, rid, mid int
+	}
+
+	pairs := make(map[int]int)
+	inflight := make(map[msgID][]int)
+	for i, ev := range events {
+		if !ev.hasMsg() {
+			continue
+		}
+
+		id := msgID{ev.sender, ev.mtype, ev.ssid, ev.rid, ev.mid}
+		if ev.kind == EVENT_SEND {
+			inflight[id] = append(inflight[id], i)
+			continue
+		}
+
+		if sent := inflight[id]; len(sent) > 0 {
+			pairs[sent[0]] = i
+			inflight[id] = sent[1:]
+		}
+	}
+	return pairs
+}
+
+// sequenceDiagram draws the messages, ratchets and keychain switches of a
+// recorded trace. A message which is not delivered right after being sent is
+// numbered, noted when sent and drawn as a late arrow when received.
+func sequenceDiagram(events []event, format string) (string, error) {
+	syntax, ok := diagramSyntaxes[format]
+	if !ok {
+		return "", fmt.Errorf("unknown diagram format: %q", format)
+	}
+
+	pairs := deliveries(events)
+	late := make(map[int]int)
+	out := new(bytes.Buffer)
+	out.WriteString(syntax.header)
+
+	seen := make(map[string]bool)
+	for _, ev := range events {
+		for _, name := range []string{ev.sender, ev.entity} {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				fmt.Fprintf(out, syntax.participant, name)
+			}
+		}
+	}
+
+	for i, ev := range events {
+		switch ev.kind {
+		case EVENT_SEND:
+			received, ok := pairs[i]
+			if !ok {
+				fmt.Fprintf(out, syntax.note, ev.entity, "sends "+msgLabel(ev)+" (never received)")
+				continue
+			}
+			if !trafficBetween(events, i, received) {
+				continue
+			}
+			late[received] = len(late) + 1
+			fmt.Fprintf(out, syntax.note, ev.entity, fmt.Sprintf("sends #%d %s", len(late), msgLabel(ev)))
+		case EVENT_RECEIVE:
+			if n, ok := late[i]; ok {
+				fmt.Fprintf(out, syntax.lateArrow, ev.sender, ev.entity, fmt.Sprintf("#%d %s", n, msgLabel(ev)))
+			} else {
+				fmt.Fprintf(out, syntax.arrow, ev.sender, ev.entity, msgLabel(ev))
+			}
+		case EVENT_RATCHET, EVENT_FOLLOW_RATCHET:
+			fmt.Fprintf(out, syntax.note, ev.entity, fmt.Sprintf("%s rid=%d", eventNames[ev.kind], ev.rid))
+		case EVENT_KEYCHAIN_SWITCH:
+			fmt.Fprintf(out, syntax.note, ev.entity, fmt.Sprintf("keychain switch ssid=%d", ev.ssid))
+		case EVENT_AUTHSTATE:
+			fmt.Fprintf(out, syntax.note, ev.entity, authStateNames[ev.AuthState])
+		case EVENT_DECRYPT_FAIL:
+			fmt.Fprintf(out, syntax.note, ev.entity, "decrypt FAILED "+msgLabel(ev))
+		case EVENT_NOTE:
+			fmt.Fprintf(out, syntax.note, ev.entity, ev.note)
+		case EVENT_REJECT:
+			fmt.Fprintf(out, syntax.note, ev.entity, "rejected: "+ev.note)
+		}
+	}
+
+	out.WriteString(syntax.footer)
+	return out.String(), nil
+}
+
+func trafficBetween(events []event, from, to int) bool {
+	for _, ev := range events[from+1 : to] {
+		if ev.hasMsg() {
+			return true
+		}
+	}
+	return false
+}
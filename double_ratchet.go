@@ -1,37 +1,62 @@
+//go:build double_ratchet
+// +build double_ratchet
+
+// Run with: go run -tags double_ratchet .
 package main
 
 import (
 	"bytes"
 	"fmt"
-
-	"golang.org/x/crypto/sha3"
-
-	"github.com/twstrike/ed448"
+	"io"
+	"os"
 )
 
+const designName = "double_ratchet"
+
 const (
 	Q = iota
 	P1
 	P2
 	D
+	ERR
 )
 
+var msgTypeNames = []string{
+	Q:   "Q",
+	P1:  "P1",
+	P2:  "P2",
+	D:   "D",
+	ERR: "ERR",
+}
+
 type Msg struct {
 	mtype    int
 	sender   string
 	rid, mid int
 	dh       pubkey
 
-	encKey key // this is here only to check if we can decrypt
+	encKey     key    // this is here only to check if we can decrypt
+	ciphertext []byte // sealed with encKey
+	text       string // of ERR messages
+}
+
+func (m Msg) decryptWith(k key) bool {
+	return bytes.Equal(k, m.encKey)
 }
 
-func (m Msg) decryptWith(k key) {
-	if !bytes.Equal(k, m.encKey) {
-		panic("failed to decrypt message.")
+func (e *Entity) decrypt(m Msg, k key) bool {
+	if !m.decryptWith(k) {
+		return false
 	}
+	_, err := e.provider().open(k, m.ciphertext)
+	return err == nil
+}
+
+// transcript shows everything a message carries, keys included.
+func (m Msg) transcript() string {
+	return fmt.Sprintf("%s %s %d %d %x %x", m.sender, msgTypeNames[m.mtype], m.rid, m.mid, m.dh, m.encKey)
 }
 
-var c = ed448.NewCurve()
 var NULLSEC = seckey{}
 var NULLPUB = pubkey{}
 
@@ -39,6 +64,13 @@ type seckey [144]byte
 type pubkey [56]byte
 type key []byte
 
+type AuthState int
+
+const (
+	AUTHSTATE_NONE AuthState = iota
+	AUTHSTATE_AWAITING_DRE_AUTH
+)
+
 type Entity struct {
 	name                 string
 	our_dh_pub, their_dh pubkey
@@ -46,31 +78,46 @@ type Entity struct {
 	R                    []key
 	Ca, Cb               []key
 	rid, j, k            int
+
+	tracer tracer
+	rand   io.Reader
+	crypto provider
+	outbox []Msg // error messages, for the caller to deliver
+}
+
+func (e *Entity) trace(ev event) {
+	ev.entity = e.name
+	if e.tracer == nil {
+		defaultTracer.trace(ev)
+		return
+	}
+	e.tracer.trace(ev)
+}
+
+func (e *Entity) traceMsg(kind eventType, m Msg) {
+	e.trace(event{kind: kind, mtype: m.mtype, sender: m.sender, rid: m.rid, mid: m.mid})
 }
 
 func (e *Entity) sendData() Msg {
 	var cj key
 	if e.j == 0 {
-		fmt.Println()
-		fmt.Printf("%s \tRatcheting...\n", e.name)
-		e.our_dh_priv, e.our_dh_pub, _ = c.GenerateKeys()
+		e.our_dh_priv, e.our_dh_pub = e.generateKeys()
 		e.rid += 1
-		secret := c.ComputeSecret(e.our_dh_priv, e.their_dh)
+		secret := e.mustComputeSecret(e.our_dh_priv, e.their_dh)
 		e.derive(secret[:])
+		e.trace(event{kind: EVENT_RATCHET, rid: e.rid})
 	}
 
 	cj = e.retriveChainkey(e.rid, e.j)
-	toSend := Msg{D, e.name, e.rid, e.j, e.our_dh_pub, cj}
+	toSend := Msg{mtype: D, sender: e.name, rid: e.rid, mid: e.j, dh: e.our_dh_pub, encKey: cj, ciphertext: e.provider().seal(cj, nil)}
 	e.j += 1
 
-	fmt.Printf("%s \tsending: %v\n", e.name, toSend)
-	fmt.Printf("%s \tour key: %x\n", e.name, cj)
+	e.traceMsg(EVENT_SEND, toSend)
 	return toSend
 }
 
 func (e *Entity) receive(m Msg) {
-	fmt.Println()
-	fmt.Printf("%s \treceive: %v\n", e.name, m)
+	e.traceMsg(EVENT_RECEIVE, m)
 	switch m.mtype {
 	case D:
 		e.receiveData(m)
@@ -83,14 +130,30 @@ func (e *Entity) receive(m Msg) {
 	case P2:
 		e.receiveP2(m)
 		break
+	case ERR:
+		e.trace(event{kind: EVENT_NOTE, rid: e.rid, note: "peer: " + m.text})
 	}
 }
 
+// sendError tells the peer we could not read what they sent. Only a new
+// DAKE gets us back in sync.
+func (e *Entity) sendError(code errorCode) {
+	toSend := Msg{mtype: ERR, sender: e.name, text: errorText(code)}
+	e.traceMsg(EVENT_SEND, toSend)
+	e.outbox = append(e.outbox, toSend)
+}
+
+func (e *Entity) takeOutbox() []Msg {
+	out := e.outbox
+	e.outbox = nil
+	return out
+}
+
 func (e *Entity) receiveP1(m Msg) {
 	e.their_dh = m.dh
 	e.rid = e.rid + 1
 	if bytes.Compare(e.our_dh_priv[:], NULLSEC[:]) == 1 {
-		secret := c.ComputeSecret(e.our_dh_priv, e.their_dh)
+		secret := e.mustComputeSecret(e.our_dh_priv, e.their_dh)
 		e.derive(secret[:])
 	}
 }
@@ -99,28 +162,42 @@ func (e *Entity) receiveP2(m Msg) {
 	e.their_dh = m.dh
 	e.rid = e.rid + 1
 
-	secret := c.ComputeSecret(e.our_dh_priv, e.their_dh)
+	secret := e.mustComputeSecret(e.our_dh_priv, e.their_dh)
 	e.derive(secret[:])
 }
 
 func (e *Entity) receiveData(m Msg) {
 	ck := make([]byte, 64)
 	if m.rid == e.rid+1 {
-		fmt.Printf("%s \tFollow Ratcheting...\n", e.name)
 		e.rid = m.rid
 		e.their_dh = m.dh
-		secret := c.ComputeSecret(e.our_dh_priv, e.their_dh)
+		secret := e.mustComputeSecret(e.our_dh_priv, e.their_dh)
 		e.derive(secret[:])
 		e.j = 0 // need to ratchet next time when send
+		e.trace(event{kind: EVENT_FOLLOW_RATCHET, rid: e.rid})
 	} else if e.k > m.mid {
 		//panic("we received a message delayed out of order")
 	}
+	if m.rid > e.rid || m.rid >= len(e.Ca) {
+		// we have no keys for its ratchet: nothing but a new DAKE helps
+		e.traceMsg(EVENT_DECRYPT_FAIL, m)
+		e.sendError(ERROR_UNREADABLE)
+		return
+	}
 
 	e.k = m.mid
 	ck = e.retriveChainkey(m.rid, m.mid)
-	fmt.Printf("%s \ttheir key: %x\n", e.name, ck)
 
-	m.decryptWith(ck)
+	if !e.decrypt(m, ck) {
+		e.traceMsg(EVENT_DECRYPT_FAIL, m)
+		e.sendError(ERROR_UNREADABLE)
+		return
+	}
+	e.traceMsg(EVENT_DECRYPT_OK, m)
+}
+
+func (e *Entity) currentRid() int {
+	return e.rid
 }
 
 func (e *Entity) wasAliceAt(rid int) bool {
@@ -138,7 +215,7 @@ func (e *Entity) retriveChainkey(rid, mid int) key {
 	}
 	copy(buf, ck)
 	for i := mid; i > 0; i-- {
-		sha3.ShakeSum256(buf, buf)
+		e.provider().kdf(buf, buf)
 	}
 	return buf
 }
@@ -150,49 +227,81 @@ func (e *Entity) derive(secret []byte) {
 	if len(e.R) > 0 {
 		secret = append(secret, e.R[e.rid-1]...)
 	}
-	sha3.ShakeSum256(r, append(secret, 0))
-	sha3.ShakeSum256(ca, append(secret, 1))
-	sha3.ShakeSum256(cb, append(secret, 2))
+	e.provider().kdf(r, append(secret, 0))
+	e.provider().kdf(ca, append(secret, 1))
+	e.provider().kdf(cb, append(secret, 2))
 
 	e.R = append(e.R, r)
 	e.Ca = append(e.Ca, ca)
 	e.Cb = append(e.Cb, cb)
 }
 
+// deriveVector runs derive as in the first ratchet after one whose root key
+// was prevRoot, or as in the DAKE when there is none.
+func deriveVector(secret, prevRoot key) (r, ca, cb key) {
+	e := new(Entity)
+	if prevRoot != nil {
+		e.R = []key{prevRoot}
+		e.rid = 1
+	}
+	e.derive(append(key{}, secret...))
+
+	return e.R[len(e.R)-1], e.Ca[len(e.Ca)-1], e.Cb[len(e.Cb)-1]
+}
+
+// chainKeyVector runs retriveChainkey on a chain starting at ck.
+func chainKeyVector(ck key, mid int) key {
+	e := &Entity{Ca: []key{nil, ck}}
+	return e.retriveChainkey(1, mid)
+}
+
 func (e *Entity) query() Msg {
 	toSend := Msg{mtype: Q, sender: e.name}
-	fmt.Printf("%s \tsending: %v\n", e.name, toSend)
+	e.traceMsg(EVENT_SEND, toSend)
 	return toSend
 }
 
 func (e *Entity) sendP1() Msg {
-	e.our_dh_priv, e.our_dh_pub, _ = c.GenerateKeys()
+	e.our_dh_priv, e.our_dh_pub = e.generateKeys()
 
 	e.j = 1
 	e.rid = e.rid + 1
 	if bytes.Compare(e.their_dh[:], NULLPUB[:]) == 1 {
-		secret := c.ComputeSecret(e.our_dh_priv, e.their_dh)
+		secret := e.mustComputeSecret(e.our_dh_priv, e.their_dh)
 		e.derive(secret[:])
 	}
 
-	toSend := Msg{P1, e.name, -1, -1, e.our_dh_pub, nil}
-	fmt.Printf("%s \tsending: %v\n", e.name, toSend)
+	toSend := Msg{mtype: P1, sender: e.name, rid: -1, mid: -1, dh: e.our_dh_pub}
+	e.traceMsg(EVENT_SEND, toSend)
 	return toSend
 }
 
 func (e *Entity) sendP2() Msg {
 	e.j = 0
 	e.rid = e.rid + 1
-	e.our_dh_priv, e.our_dh_pub, _ = c.GenerateKeys()
-	secret := c.ComputeSecret(e.our_dh_priv, e.their_dh)
+	e.our_dh_priv, e.our_dh_pub = e.generateKeys()
+	secret := e.mustComputeSecret(e.our_dh_priv, e.their_dh)
 	e.derive(secret[:])
 
-	toSend := Msg{P2, e.name, -1, -1, e.our_dh_pub, nil}
-	fmt.Printf("%s \tsending: %v\n", e.name, toSend)
+	toSend := Msg{mtype: P2, sender: e.name, rid: -1, mid: -1, dh: e.our_dh_pub}
+	e.traceMsg(EVENT_SEND, toSend)
 	return toSend
 }
 
+// scenarioSends are the sends a scenario step can do.
+var scenarioSends = map[string]func(e *Entity) Msg{
+	"query":    (*Entity).query,
+	"sendP1":   (*Entity).sendP1,
+	"sendP2":   (*Entity).sendP2,
+	"sendData": (*Entity).sendData,
+}
+
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	defer closeTrace()
+
 	var a, b *Entity
 
 	//XXX They are all good so far
@@ -215,6 +324,22 @@ func main() {
 
 		testAsyncDataMessages(runFreshDAKE())
 
+		fmt.Println("=========================")
+		fmt.Println("Testing error messages")
+		fmt.Println("=========================")
+
+		testErrorMessages(runFreshDAKE())
+
+		fmt.Println("=========================")
+		fmt.Println("Testing lost first message of a ratchet")
+		fmt.Println("=========================")
+
+		testLostFirstMessage(runFreshDAKE())
+		testLateFirstMessage(runFreshDAKE())
+		a, b = runFreshDAKE()
+		testLostFirstMessage(b, a)
+		testLateFirstMessage(b, a)
+
 		fmt.Println("=========================")
 		fmt.Println("Testing new sync DAKE")
 		fmt.Println("=========================")
@@ -427,6 +552,47 @@ func testAsyncDataMessages(a, b *Entity) {
 	a.receive(m2) // a receives a message from a new ratchet. She follows the ratchet.
 }
 
+// testLostFirstMessage has b lose the first message of the new ratchet of a.
+// The next one carries the same dh, so b follows the ratchet from it.
+func testLostFirstMessage(a, b *Entity) {
+	a.receive(b.sendData()) // so that a starts a new ratchet next
+	rid := b.currentRid()
+	a.sendData() // lost
+	b.receive(a.sendData())
+	if b.currentRid() != rid+1 {
+		panic("should follow a ratchet from any of its messages")
+	}
+	a.receive(b.sendData()) // b starts a new ratchet, a follows it
+}
+
+// testErrorMessages has b tell a about a data message it can not read, where
+// it used to crash.
+func testErrorMessages(a, b *Entity) {
+	a.receive(b.sendData())
+	m := a.sendData()
+	m.ciphertext = append([]byte{}, m.ciphertext...)
+	m.ciphertext[0] ^= 1
+	b.receive(m)
+	out := b.takeOutbox()
+	if len(out) != 1 || out[0].mtype != ERR || out[0].text != errorText(ERROR_UNREADABLE) {
+		panic("should answer an unreadable message with an error message")
+	}
+	a.receive(out[0])
+}
+
+// testLateFirstMessage has the first message of the new ratchet of a arrive
+// after a later one, and after b sent in the ratchet following it.
+func testLateFirstMessage(a, b *Entity) {
+	a.receive(b.sendData()) // so that a starts a new ratchet next
+	m0 := a.sendData()
+	m1 := a.sendData()
+	b.receive(m1)      // b follows the ratchet from its second message
+	m2 := b.sendData() // b starts a new ratchet
+	b.receive(m0)      // and still derives the key of the skipped one
+	a.receive(m2)
+	testSyncDataMessages(a, b)
+}
+
 // NOTE The late message may or may not be a follow up.
 // NOTE Bob does not receive any message after starting the DAKE.
 // NOTE Bob does not receive any late messages after both finish the DAKE.
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OTR error messages tell the peer that something they sent went wrong.
+// They are not encrypted, and never change the state of the receiver.
+type errorCode int
+
+const (
+	ERROR_UNREADABLE  errorCode = iota + 1 // we could not decrypt it
+	ERROR_NOT_PRIVATE                      // we have no session to decrypt it in
+	ERROR_MALFORMED                        // we decrypted something we could not parse
+)
+
+var errorCodeTexts = []string{
+	ERROR_UNREADABLE:  "Unreadable message",
+	ERROR_NOT_PRIVATE: "Not in private state message",
+	ERROR_MALFORMED:   "Malformed message",
+}
+
+const errorPrefix = "?OTR Error: "
+
+func errorText(code errorCode) string {
+	return fmt.Sprintf("%sERROR_%d: %s", errorPrefix, code, errorCodeTexts[code])
+}
+
+func parseErrorText(text string) (errorCode, bool) {
+	var code errorCode
+	if !strings.HasPrefix(text, errorPrefix) {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(text[len(errorPrefix):], "ERROR_%d:", &code); err != nil {
+		return 0, false
+	}
+	if code < ERROR_UNREADABLE || int(code) >= len(errorCodeTexts) {
+		return 0, false
+	}
+	return code, true
+}
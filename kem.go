@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// A kem is a key encapsulation mechanism. It refreshes the brace key of the
+// ratchet, so that root keys do not only rest on the hardness of ECDH.
+// validateKey fails on an encapsulation key a peer should never have sent.
+type kem interface {
+	generateKey(r io.Reader) (dk, ek []byte)
+	validateKey(ek []byte) error
+	encapsulate(ek []byte) (shared, ct []byte, err error)
+	decapsulate(dk, ct []byte) (shared []byte, err error)
+}
+
+// defaultKEM is ML-KEM-768 when the standard library has it. When it is nil
+// the brace key is only hashed from one ratchet to the next.
+var defaultKEM kem
+
+// nextBraceKey is
+//
+//	brace' = SHAKE-256("brace" || brace || shared)
+//
+// with 64 bytes of output, and shared empty when nothing was encapsulated.
+func nextBraceKey(brace, shared []byte) key {
+	out := make(key, 64)
+	h := sha3.NewShake256()
+	h.Write([]byte("brace"))
+	h.Write(brace)
+	h.Write(shared)
+	h.Read(out)
+	return out
+}
@@ -0,0 +1,52 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"crypto/mlkem"
+	"io"
+)
+
+func init() {
+	defaultKEM = mlkem768{}
+}
+
+// mlkem768 is ML-KEM-768 from FIPS 203. The decapsulation key is kept as its
+// seed. Encapsulation draws from crypto/rand, so runs with a brace key are not
+// reproducible from a seed.
+type mlkem768 struct{}
+
+func (mlkem768) generateKey(r io.Reader) (dk, ek []byte) {
+	dk = make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(r, dk); err != nil {
+		panic("failed to generate keys.")
+	}
+	k, err := mlkem.NewDecapsulationKey768(dk)
+	if err != nil {
+		panic("failed to generate keys.")
+	}
+	return dk, k.EncapsulationKey().Bytes()
+}
+
+func (mlkem768) validateKey(ek []byte) error {
+	_, err := mlkem.NewEncapsulationKey768(ek)
+	return err
+}
+
+func (mlkem768) encapsulate(ek []byte) (shared, ct []byte, err error) {
+	k, err := mlkem.NewEncapsulationKey768(ek)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, ct = k.Encapsulate()
+	return shared, ct, nil
+}
+
+func (mlkem768) decapsulate(dk, ct []byte) ([]byte, error) {
+	k, err := mlkem.NewDecapsulationKey768(dk)
+	if err != nil {
+		return nil, err
+	}
+	return k.Decapsulate(ct)
+}
@@ -0,0 +1,266 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const dh3072Every = 3
+
+var errBraceCiphertext = errors.New("brace key ciphertext we can not decapsulate")
+
+func (e *Entity) usesBrace() bool {
+	return e.braceEvery > 0 || e.mixDH
+}
+
+// checkBrace validates the keys of the brace key refresh m carries, as soon
+// as it arrives.
+func checkBrace(m Msg) error {
+	if m.kemEk != nil && defaultKEM != nil {
+		if err := defaultKEM.validateKey(m.kemEk); err != nil {
+			return err
+		}
+	}
+	if m.dh3072 != nil {
+		return dh3072Check(m.dh3072)
+	}
+	return nil
+}
+
+// refreshBrace moves the brace key of kc as we start a ratchet in it, or the
+// DAKE. On the ratchets where the KEM or the 3072-bit DH is due we
+// encapsulate to their KEM key and do a DH with their last DH value, if we
+// have them, and send new ones of ours. Otherwise the brace key is only
+// hashed. kc is left alone when it fails.
+func (e *Entity) refreshBrace(kc *keychain) error {
+	var shared, kemCt []byte
+	var kemDk, kemEk []byte
+	var dh3072Priv, dh3072Pub *big.Int
+
+	kemDue := e.braceEvery > 0 && kc.rid%e.braceEvery == 0 && defaultKEM != nil
+	if kemDue {
+		if kc.their_kem_ek != nil {
+			ss, ct, err := defaultKEM.encapsulate(kc.their_kem_ek)
+			if err != nil {
+				return err
+			}
+			shared, kemCt = append(shared, ss...), ct
+		}
+		kemDk, kemEk = defaultKEM.generateKey(e.randReader())
+	}
+
+	dhDue := e.mixDH && kc.rid%dh3072Every == 0
+	if dhDue {
+		dh3072Priv, dh3072Pub = generateDH3072(e.randReader())
+		if kc.their_dh3072 != nil {
+			ss, err := dh3072Secret(dh3072Priv, kc.their_dh3072)
+			if err != nil {
+				return err
+			}
+			shared = append(shared, ss...)
+		}
+	}
+
+	kc.sent_kem_ek, kc.sent_kem_ct, kc.sent_dh3072 = kemEk, kemCt, dh3072Pub
+	if kemDue {
+		kc.our_kem_dk = kemDk
+	}
+	if dhDue {
+		kc.our_dh3072_priv = dh3072Priv
+	}
+	kc.brace = nextBraceKey(kc.brace, shared)
+	return nil
+}
+
+// followBrace moves the brace key of kc as the peer did when starting the
+// ratchet of m. kc is left alone when it fails.
+func (e *keychain) followBrace(m Msg) error {
+	if err := checkBrace(m); err != nil {
+		return err
+	}
+	var shared []byte
+	if m.kemCt != nil {
+		if defaultKEM == nil || e.our_kem_dk == nil {
+			return errBraceCiphertext
+		}
+		ss, err := defaultKEM.decapsulate(e.our_kem_dk, m.kemCt)
+		if err != nil {
+			return errBraceCiphertext
+		}
+		shared = append(shared, ss...)
+	}
+	if m.dh3072 != nil && e.our_dh3072_priv != nil {
+		ss, err := dh3072Secret(e.our_dh3072_priv, m.dh3072)
+		if err != nil {
+			return err
+		}
+		shared = append(shared, ss...)
+	}
+
+	if m.kemEk != nil {
+		e.their_kem_ek = m.kemEk
+	}
+	if m.dh3072 != nil {
+		e.their_dh3072 = m.dh3072
+	}
+	e.brace = nextBraceKey(e.brace, shared)
+	return nil
+}
+
+// NOTE It also prints what the brace key costs on the wire.
+func testBraceKey(a, b *Entity) {
+	msgs, withKEM, kemBytes := 0, 0, 0
+	deliver := func(to *Entity, m Msg) {
+		msgs++
+		if m.kemEk != nil || m.kemCt != nil {
+			withKEM++
+			kemBytes += len(m.kemEk) + len(m.kemCt)
+		}
+		to.receive(m)
+	}
+
+	for i := 0; i < 6; i++ {
+		deliver(a, mustSend(b.sendData()))
+		deliver(a, mustSend(b.sendData()))
+		deliver(b, mustSend(a.sendData()))
+		deliver(b, mustSend(a.sendData()))
+
+		if !bytes.Equal(a.current.brace, b.current.brace) {
+			panic("should have the same brace key")
+		}
+	}
+
+	// the first message of a ratchet which refreshes the brace key is late
+	for (b.current.rid+1)%b.braceEvery != 0 {
+		deliver(a, mustSend(b.sendData()))
+		deliver(b, mustSend(a.sendData()))
+	}
+	m1 := mustSend(b.sendData())
+	m2 := mustSend(b.sendData())
+	if defaultKEM != nil && (m1.kemCt == nil || !bytes.Equal(m1.kemCt, m2.kemCt)) {
+		panic("every message of the ratchet should carry the refresh")
+	}
+	deliver(a, m2)
+	deliver(a, m1)
+	deliver(b, mustSend(a.sendData()))
+
+	if defaultKEM != nil && withKEM == 0 {
+		panic("should have refreshed the brace key with the KEM")
+	}
+	fmt.Printf("brace key: %d of %d messages carry %d bytes of KEM data\n", withKEM, msgs, kemBytes)
+}
+
+// NOTE Bob sends brace keys which are not keys. Alice must reject them
+// NOTE before they reach her keychains.
+func testBadBraceKeys() {
+	a, b := initialize()
+	a.braceEvery, b.braceEvery = 1, 1
+	a.mixDH, b.mixDH = true, true
+	rec := &recordTracer{}
+	a.tracer = multiTracer{defaultTracer, rec}
+
+	b.receive(a.query())
+	p1 := b.sendP1()
+	resign := func(m Msg) Msg {
+		m.sig = b.provider().sign(b.our_identity_priv, m.dakeBody())
+		return m
+	}
+	var bad []Msg
+	shortEk := p1
+	shortEk.kemEk = p1.kemEk[:len(p1.kemEk)/2]
+	badDH := p1
+	badDH.dh3072 = big.NewInt(1)
+	if defaultKEM != nil {
+		bad = append(bad, resign(shortEk))
+	}
+	bad = append(bad, resign(badDH))
+	for _, m := range bad {
+		a.receive(m)
+	}
+	if countEvents(rec, EVENT_REJECT) != len(bad) || a.pending != nil {
+		panic("a P1 with a bad brace key should be rejected")
+	}
+
+	a.receive(p1)
+	b.receive(mustSend(a.sendP2()))
+	testSyncDataMessages(a, b) // Bob ratchets next, and refreshes the brace key
+
+	m := mustSend(b.sendData())
+	rid, brace := a.currentRid(), a.current.brace
+	truncated := m
+	truncated.kemCt = m.kemCt[:len(m.kemCt)/2]
+	badDH = m
+	badDH.dh3072 = dh3072P
+	bad = []Msg{badDH}
+	if defaultKEM != nil {
+		bad = append(bad, truncated)
+	}
+	rejects := countEvents(rec, EVENT_REJECT)
+	for _, m := range bad {
+		a.receive(m)
+	}
+	if countEvents(rec, EVENT_REJECT) != rejects+len(bad) || a.currentRid() != rid || !bytes.Equal(a.current.brace, brace) {
+		panic("a data message with a bad brace key should be rejected, and leave the ratchet alone")
+	}
+	a.receive(m)
+	testSyncDataMessages(a, b)
+	a.tracer = nil
+}
+
+// NOTE Every message of a ratchet carries its DH value, so it does not matter
+// NOTE which of them arrives first, or if the first one never does.
+func testMixedDH(a, b *Entity) {
+	for _, bad := range []*big.Int{nil, big.NewInt(1), new(big.Int).Sub(dh3072P, big.NewInt(1)), dh3072P} {
+		if _, err := dh3072Secret(big.NewInt(42), bad); err != errBadDH3072 {
+			panic("should not accept a bad DH value")
+		}
+	}
+
+	testSyncDataMessages(a, b) // Bob ratchets next
+
+	// untilDHRatchet runs until the next ratchet of Bob is a DH one
+	untilDHRatchet := func() {
+		for (b.current.rid+1)%dh3072Every != 0 {
+			a.receive(mustSend(b.sendData()))
+			b.receive(mustSend(a.sendData()))
+		}
+	}
+	sameBrace := func() {
+		if !bytes.Equal(a.current.brace, b.current.brace) {
+			panic("should have the same brace key")
+		}
+	}
+
+	// the first message with the new DH value is lost
+	untilDHRatchet()
+	lost := mustSend(b.sendData())
+	if lost.dh3072 == nil {
+		panic("should carry the new DH value")
+	}
+	a.receive(mustSend(b.sendData()))
+	sameBrace()
+
+	m := mustSend(a.sendData())
+	if m.dh3072 != nil {
+		panic("should only carry a DH value when it changes")
+	}
+	b.receive(m)
+	sameBrace()
+
+	// the first message with the new DH value arrives after a new ratchet
+	untilDHRatchet()
+	late := mustSend(b.sendData())
+	a.receive(mustSend(b.sendData()))
+	b.receive(mustSend(a.sendData()))
+	a.receive(mustSend(b.sendData()))
+	a.receive(late)
+	sameBrace()
+
+	testSyncDataMessages(a, b)
+	sameBrace()
+}
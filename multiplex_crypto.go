@@ -0,0 +1,88 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+func testPointValidation() {
+	point := func(n *big.Int) (pub pubkey) {
+		be := n.FillBytes(make([]byte, 56))
+		for i := range be {
+			pub[55-i] = be[i]
+		}
+		return
+	}
+	one := big.NewInt(1)
+
+	var x x448Curve
+	priv, _ := x.generateKeys(new(Entity).randReader())
+	for _, c := range []struct {
+		pub pubkey
+		err error
+	}{
+		{point(big.NewInt(0)), errSmallOrder}, // the identity
+		{point(one), errSmallOrder},
+		{point(new(big.Int).Sub(x448P, one)), errSmallOrder},
+		{point(x448P), errInvalidPoint}, // 0, not canonical
+		{point(new(big.Int).Add(x448P, one)), errInvalidPoint},
+		{point(big.NewInt(6)), errInvalidPoint}, // on the twist
+	} {
+		if _, err := x.computeSecret(priv, c.pub); err != c.err {
+			panic(fmt.Sprintf("expected %v, got %v", c.err, err))
+		}
+	}
+
+	a, b := initialize()
+	a.crypto, b.crypto = standardProvider{x448Curve{}}, standardProvider{x448Curve{}}
+	testSyncDataMessages(testSyncDAKE(a, b)) // Bob ratchets next
+
+	rec := &recordTracer{}
+	a.tracer = multiTracer{defaultTracer, rec}
+
+	// Bob starts a ratchet with the identity point
+	m := mustSend(b.sendData())
+	m.dh = point(big.NewInt(0))
+	rid, dh := a.currentRid(), a.current.their_dh
+	a.receive(m)
+	if countEvents(rec, EVENT_REJECT) != 1 || a.currentRid() != rid || a.current.their_dh != dh {
+		panic("a small order point should be rejected, and leave the ratchet alone")
+	}
+
+	// and a DAKE with a point on the twist
+	b.receive(a.query())
+	p1 := b.sendP1()
+	p1.dh = point(big.NewInt(6))
+	p1.sig = b.provider().sign(b.our_identity_priv, p1.dakeBody())
+	a.receive(p1)
+	if countEvents(rec, EVENT_REJECT) != 2 || a.pending != nil {
+		panic("a P1 with an invalid point should be rejected")
+	}
+	a.tracer = nil
+}
+
+func testCountingProvider() {
+	a, b := initialize()
+	ca, cb := newCountingProvider(a.provider()), newCountingProvider(b.provider())
+	a.crypto, b.crypto = ca, cb
+
+	testSyncDataMessages(testSyncDAKE(a, b))
+	fmt.Printf("%s: %s\n%s: %s\n", a.name, ca, b.name, cb)
+
+	// each of them sent two data messages and received two
+	for _, c := range []*countingProvider{ca, cb} {
+		if c.counts["seal"] != 2 || c.counts["open"] != 2 {
+			panic("should have sealed and opened every data message once")
+		}
+		if c.counts["sign"] != 2 || c.counts["verify"] != 2 {
+			panic("should have signed our profile and DAKE message, and verified theirs")
+		}
+	}
+	// Alice ratcheted once and Bob followed
+	if ca.counts["dh"] != 2 || cb.counts["dh"] != 2 {
+		panic("should have done a DH in the DAKE and one in the ratchet")
+	}
+}
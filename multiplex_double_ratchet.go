@@ -1,38 +1,121 @@
+//go:build multiplex
+// +build multiplex
+
+// Run with: go run -tags multiplex .
 package main
 
 import (
 	"bytes"
+	"crypto/dsa"
+	"encoding/binary"
+	"errors"
 	"fmt"
-
-	"golang.org/x/crypto/sha3"
-
-	"github.com/twstrike/ed448"
+	"io"
+	"math/big"
+	"os"
+	"time"
 )
 
+const designName = "multiplex"
+
 const (
 	Q = iota
 	P1
 	P2
 	D
+	NI
+	PT // plaintext
+
+	// OTRv3 AKE
+	DHC // DH-Commit
+	DHK // DH-Key
+	RS  // Reveal Signature
+	SIG // Signature
+
+	ERR // error message
 )
 
+var msgTypeNames = []string{
+	Q:  "Q",
+	P1: "P1",
+	P2: "P2",
+	D:  "D",
+	NI: "NI",
+	PT: "PT",
+
+	DHC: "DHC",
+	DHK: "DHK",
+	RS:  "RS",
+	SIG: "SIG",
+
+	ERR: "ERR",
+}
+
 type Msg struct {
 	mtype    int
 	sender   string
 	rid, mid int
 	dh       pubkey
 
-	encKey key // this is here only to check if we can decrypt
-	ssid   int
+	encKey     key    // this is here only to check if we can decrypt
+	ciphertext []byte // sealed with encKey
+	ssid       int
+
+	prekeyID uint32         // the prekey message a NI message answers
+	profile  *clientProfile // sent with P1, P2 and NI
+	version  byte           // of the DAKE, picked by whoever sends P1
+	versions string         // of the query P1 answers, so that a downgrade breaks its signature
+	text     string         // of Q, PT and ERR messages
+
+	// brace key refresh, sent in every message of its ratchet
+	kemEk, kemCt []byte
+	dh3072       *big.Int
+
+	sig [112]byte // of the DAKE so far, by the identity key of the sender of P1, P2 and NI
+
+	revealed []key // MAC keys of messages the sender received, for deniability
+
+	v3 *v3Msg // of OTRv3 sessions
+}
+
+func (m Msg) decryptWith(k key) bool {
+	return bytes.Equal(k, m.encKey)
 }
 
-func (m Msg) decryptWith(k key) {
-	if !bytes.Equal(k, m.encKey) {
-		panic("failed to decrypt message.")
+func (e *Entity) decrypt(m Msg, k key) ([]byte, bool) {
+	if !m.decryptWith(k) {
+		return nil, false
 	}
+	plaintext, err := e.provider().open(k, m.ciphertext)
+	return plaintext, err == nil
+}
+
+// transcript shows everything a message carries, keys included.
+func (m Msg) transcript() string {
+	return fmt.Sprintf("%s %s %d %d %d %x %x", m.sender, msgTypeNames[m.mtype], m.ssid, m.rid, m.mid, m.dh, m.encKey)
 }
 
-var c = ed448.NewCurve()
+// dakeBody is what the sender of a DAKE message signs with its identity key,
+// after the DAKE messages which came before it.
+func (m Msg) dakeBody() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint32(m.mtype))
+	writeBytes(b, []byte(m.sender))
+	binary.Write(b, binary.BigEndian, int64(m.ssid))
+	b.Write(m.dh[:])
+	b.WriteByte(m.version)
+	writeBytes(b, []byte(m.versions))
+	binary.Write(b, binary.BigEndian, m.prekeyID)
+	if m.profile != nil {
+		writeBytes(b, m.profile.body())
+	}
+	writeBytes(b, m.kemEk)
+	writeBytes(b, m.kemCt)
+	if m.dh3072 != nil {
+		writeBytes(b, m.dh3072.Bytes())
+	}
+	return b.Bytes()
+}
 
 type seckey [144]byte
 type pubkey [56]byte
@@ -45,12 +128,132 @@ const (
 	AUTHSTATE_AWAITING_DRE_AUTH
 )
 
+// MsgState says whether what we send is encrypted. It moves to ENCRYPTED
+// when a DAKE completes, and to FINISHED when the peer ends the session.
+// A query in FINISHED goes back to PLAINTEXT while the new DAKE runs.
+// Errors never move it: anyone who can inject a message could downgrade the
+// conversation otherwise.
+type MsgState int
+
+const (
+	MSGSTATE_PLAINTEXT MsgState = iota
+	MSGSTATE_ENCRYPTED
+	MSGSTATE_FINISHED
+)
+
+var msgStateNames = []string{
+	MSGSTATE_PLAINTEXT: "PLAINTEXT",
+	MSGSTATE_ENCRYPTED: "ENCRYPTED",
+	MSGSTATE_FINISHED:  "FINISHED",
+}
+
+var (
+	errNotEncrypted   = errors.New("data message outside of an encrypted session")
+	errNoSession      = errors.New("no encrypted session to send data in")
+	errUnknownSession = errors.New("data message of an unknown session")
+	errExpiredKey     = errors.New("data message of a ratchet whose keys expired")
+	errNoDAKE         = errors.New("P2 of a DAKE we are not in")
+	errNoExtraKey     = errors.New("extra symmetric key outside of an OTRv4 session")
+	errRatchetGap     = errors.New("data message skips a ratchet")
+	errDesync         = errors.New("data message of keys we do not share")
+	errBadMessageID   = errors.New("data message with a negative id")
+	errMessageJump    = errors.New("data message skips too many messages")
+	errUnknownPrekey  = errors.New("NI of an unknown or already used prekey")
+	errDAKESignature  = errors.New("bad DAKE signature")
+	errProfileSender  = errors.New("client profile of another sender")
+)
+
+// expiryPolicy says how long we keep keys we may still need for messages
+// which are late or never arrive. Zero keeps them forever.
+type expiryPolicy struct {
+	skippedKeys time.Duration // chain keys of ratchets we moved on from
+	pending     time.Duration // keychain of a DAKE which did not complete
+	previous    time.Duration // keychain of the session before the current one
+}
+
 type keychain struct {
 	our_dh_pub, their_dh pubkey
 	our_dh_priv          seckey
 	R                    []key
 	Ca, Cb               []key
 	rid, j, k            int
+	received             []int  // the highest mid we read in each ratchet, or -1
+	transcript           []byte // of the DAKE, for the next signature
+	versions             string // of the query we answer with P1
+
+	// brace is mixed into every derive when the DAKE set one up
+	brace                    key
+	our_kem_dk, their_kem_ek []byte
+	sent_kem_ek, sent_kem_ct []byte // of the ratchet we are sending in
+
+	our_dh3072_priv, their_dh3072 *big.Int
+	sent_dh3072                   *big.Int // of the ratchet we are sending in
+
+	created     time.Time
+	ratchetedAt []time.Time // when each ratchet was derived
+	retired     time.Time   // when it became the previous keychain
+
+	crypto provider
+	clock  clock
+}
+
+// transcriptWith is the transcript of the DAKE once m is sent.
+func (e *keychain) transcriptWith(m Msg) []byte {
+	return append(append([]byte{}, e.transcript...), m.dakeBody()...)
+}
+
+func (e *Entity) newKeychain() *keychain {
+	return &keychain{crypto: e.provider(), clock: e.clock, created: e.now()}
+}
+
+func (e *keychain) kdf(out, in []byte) {
+	if e.crypto == nil {
+		defaultProvider().kdf(out, in)
+		return
+	}
+	e.crypto.kdf(out, in)
+}
+
+// macKey authenticates the data message sent with chain key ck. We reveal
+// it once we received the message.
+func (e *keychain) macKey(ck key) key {
+	k := make([]byte, 64)
+	e.kdf(k, append([]byte("mac key"), ck...))
+	return k
+}
+
+// ready tells whether the DAKE of the keychain is done.
+func (e *keychain) ready() bool {
+	return len(e.R) > 0
+}
+
+// wipe overwrites every secret of the keychain.
+func (e *keychain) wipe() {
+	for _, keys := range [][]key{e.R, e.Ca, e.Cb, {e.brace, e.our_kem_dk}} {
+		for _, k := range keys {
+			wipeKeys(k)
+		}
+	}
+	e.our_dh_priv = seckey{}
+	if e.our_dh3072_priv != nil {
+		e.our_dh3072_priv.SetInt64(0)
+	}
+	*e = keychain{}
+}
+
+// extraKey is the extra symmetric key of the data message sent with chain
+// key ck. No other message has the same.
+func (e *keychain) extraKey(ck key) key {
+	k := make([]byte, 32)
+	e.kdf(k, append([]byte("extra symmetric key"), ck...))
+	return k
+}
+
+// sessionID is the same for both entities of the session kc belongs to.
+func (e *keychain) sessionID() []byte {
+	id := make([]byte, 8)
+	e.kdf(id, append([]byte("session id"), e.R[0]...))
+	return id
 }
 
 type Entity struct {
@@ -60,11 +263,146 @@ type Entity struct {
 	pending  *keychain
 	ssid     int
 
+	our_identity_priv  seckey
+	our_identity_pub   pubkey
+	shared_prekey_priv seckey
+	shared_prekey_pub  pubkey
+	prekeys            map[uint32]*keychain // published and not used yet
+	lastPrekeyID       uint32
+	instanceTag        uint32
+	our_dsa_priv       *dsa.PrivateKey // signs our profile during the OTRv3 transition, if set
+	our_profile        *clientProfile
+	their_profile      *clientProfile
+
+	// braceEvery is how many ratchets go by between KEM refreshes of the
+	// brace key, or 0 to not use one. Both entities must agree on it.
+	braceEvery int
+
+	// mixDH mixes a 3072-bit DH into the brace key every dh3072Every
+	// ratchets, as OTRv4 does. Both entities must agree on it.
+	mixDH bool
+
+	smp          smp
+	outgoing     []tlv // sent in our next data message
+	macsToReveal []key // of the messages we received since we last sent
+	tlvHandlers  tlvRegistry
+	padding      int // data message plaintexts are padded to a multiple of it, if set
+
+	// onExtraKey gets the extra symmetric keys the peer tells us to use
+	onExtraKey func(usage uint32, context []byte, k key)
+
+	// heartbeat is how long we may go without sending after a receive, if
+	// set. Past it, we answer with an empty data message so that the peer
+	// gets a new DH key from us.
+	heartbeat time.Duration
+	lastSent  time.Time
+	outbox    []Msg // sent by ourselves, for the caller to deliver
+
+	expiry expiryPolicy
+	limits ratchetLimits
+
+	// unread holds data messages we could not read yet: those sent in a
+	// DAKE we are not done with, and those of keys we got out of sync with.
+	// They get another go when the next DAKE is done.
+	unread    []Msg
+	resyncing bool // we sent a query to get back in sync
+	replaying bool
+
+	// resyncAfter is how long we wait to read the peer again after a data
+	// message we could not read, if set. Past it, we tell the peer and start
+	// a new DAKE: the message may be forged, so it does not do so itself.
+	resyncAfter time.Duration
+	unreadSince time.Time     // the first message we could not read since we last read the peer
+	sent        []sentPayload // for the peer to ask again
+
+	policy  policy
+	version byte // of the DAKE we are in
+
+	// an OTRv3 session replaces the keychains, when we negotiate version 3
+	legacyAKE *v3AKE
+	legacy    *v3Keys
+	their_dsa *dsa.PublicKey
+
 	AuthState
+	msgState MsgState
+	tracer   tracer
+	rand     io.Reader
+	crypto   provider
+	clock    clock
+}
+
+func (e *Entity) now() time.Time {
+	return timeOn(e.clock)
+}
+
+// takeOutbox hands the messages we sent by ourselves to the caller.
+func (e *Entity) takeOutbox() []Msg {
+	out := e.outbox
+	e.outbox = nil
+	return out
+}
+
+func (e *Entity) trace(ev event) {
+	ev.entity = e.name
+	ev.AuthState = e.AuthState
+	if e.tracer == nil {
+		defaultTracer.trace(ev)
+		return
+	}
+	e.tracer.trace(ev)
+}
+
+func (e *Entity) traceMsg(kind eventType, m Msg) {
+	e.trace(event{kind: kind, mtype: m.mtype, sender: m.sender, rid: m.rid, mid: m.mid, ssid: m.ssid})
+}
+
+func (e *Entity) setAuthState(s AuthState) {
+	if e.AuthState == s {
+		return
+	}
+	e.AuthState = s
+	e.trace(event{kind: EVENT_AUTHSTATE, ssid: e.ssid})
+}
+
+func (e *Entity) setMsgState(s MsgState) {
+	if e.msgState == s {
+		return
+	}
+	e.msgState = s
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "msgstate " + msgStateNames[s]})
+}
+
+// reject drops a message we can not accept, without touching our state.
+func (e *Entity) reject(err error) {
+	e.trace(event{kind: EVENT_REJECT, ssid: e.ssid, note: err.Error()})
+}
+
+func (e *Entity) switchKeychain() {
+	if e.current != nil {
+		e.current.retired = e.now()
+	}
+	e.previous = e.current
+	e.current = e.pending
+	e.pending = nil
+	e.ssid = e.ssid + 1
+	e.trace(event{kind: EVENT_KEYCHAIN_SWITCH, ssid: e.ssid, rid: e.current.rid})
 }
 
 func (e *Entity) receive(m Msg) {
-	fmt.Println()
+	e.traceMsg(EVENT_RECEIVE, m)
+	e.expireKeys()
+	switch m.mtype {
+	case P1, P2, NI:
+		if err := m.profile.validate(e.provider(), e.now()); err != nil {
+			e.reject(err)
+			return
+		}
+		if m.profile.name != m.sender {
+			e.reject(errProfileSender)
+			return
+		}
+	}
+
 	switch m.mtype {
 	case D:
 		e.receiveData(m)
@@ -78,123 +416,372 @@ func (e *Entity) receive(m Msg) {
 	case P2:
 		e.receiveP2(m)
 		break
+	case NI:
+		e.receiveNI(m)
+		break
+	case PT:
+		e.receivePlaintext(m)
+		break
+	case DHC:
+		e.receiveDHCommit(m)
+	case DHK:
+		e.receiveDHKey(m)
+	case RS:
+		e.receiveRevealSig(m)
+	case SIG:
+		e.receiveSig(m)
+	case ERR:
+		e.receiveError(m)
 	}
 }
 
-func (e *Entity) query() Msg {
-	toSend := Msg{mtype: Q, sender: e.name}
-	fmt.Printf("%s \tsending Q\n", e.name)
-	return toSend
-}
-
-func (e *Entity) receiveQ(m Msg) {
-	fmt.Printf("%s \treceive Q\n", e.name)
-	e.pending = &keychain{}
+// startDAKE gets ready to send P1 to a peer who speaks versions.
+func (e *Entity) startDAKE(versions string) {
+	v, err := e.policy.highestCommon(versions)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	e.version = v
+	if v == '3' {
+		e.legacyAKE = &v3AKE{}
+	} else {
+		e.pending = e.newKeychain()
+		e.pending.versions = versions
+	}
+	e.leaveFinished()
 }
 
 func (e *Entity) sendP1() Msg {
-	e.pending.our_dh_priv, e.pending.our_dh_pub, _ = c.GenerateKeys()
-	toSend := Msg{P1, e.name, -1, -1, e.pending.our_dh_pub, nil, e.ssid + 1}
+	if e.version == '3' {
+		return e.sendDHCommit()
+	}
+	e.pending.our_dh_priv, e.pending.our_dh_pub = e.generateKeys()
+	toSend := Msg{mtype: P1, sender: e.name, rid: -1, mid: -1, dh: e.pending.our_dh_pub, ssid: e.ssid + 1, profile: e.profile(), version: e.version, versions: e.pending.versions}
+	if e.braceEvery > 0 && defaultKEM != nil {
+		e.pending.our_kem_dk, toSend.kemEk = defaultKEM.generateKey(e.randReader())
+	}
+	if e.mixDH {
+		e.pending.our_dh3072_priv, toSend.dh3072 = generateDH3072(e.randReader())
+	}
+	e.pending.transcript = toSend.dakeBody()
+	toSend.sig = e.provider().sign(e.our_identity_priv, e.pending.transcript)
 
-	fmt.Printf("%s \tsending P1 %d\n", e.name, toSend.ssid)
-	e.AuthState = AUTHSTATE_AWAITING_DRE_AUTH
+	e.traceMsg(EVENT_SEND, toSend)
+	e.setAuthState(AUTHSTATE_AWAITING_DRE_AUTH)
 	return toSend
 }
 
+// receiveP1 checks that P1 answers the versions we offered, under the
+// signature of the sender. A DH-Commit of OTRv3 carries no such binding, so
+// a policy which allows "3" lets an attacker downgrade us to it.
 func (e *Entity) receiveP1(m Msg) {
-	fmt.Printf("%s \treceive P1 %d\n", e.name, m.ssid)
-	e.pending = &keychain{}
+	if !e.policy.allows(m.version) {
+		e.reject(errNoCommonVersion)
+		return
+	}
+	if !e.provider().verify(m.sig, m.dakeBody(), m.profile.identity) {
+		e.reject(errDAKESignature)
+		return
+	}
+	if m.versions != e.policy.allowedVersions() {
+		e.reject(errVersionsChanged)
+		return
+	}
+	if err := e.provider().validate(m.dh); err != nil {
+		e.reject(err)
+		return
+	}
+	if err := checkBrace(m); err != nil {
+		e.reject(err)
+		return
+	}
+	e.version = m.version
+	e.their_profile = m.profile
+	e.pending = e.newKeychain()
+	e.pending.transcript = m.dakeBody()
 	e.pending.their_dh = m.dh
+	e.pending.their_kem_ek = m.kemEk
+	e.pending.their_dh3072 = m.dh3072
 }
 
-func (e *Entity) sendP2() Msg {
-	e.pending.our_dh_priv, e.pending.our_dh_pub, _ = c.GenerateKeys()
-
-	secret := c.ComputeSecret(e.pending.our_dh_priv, e.pending.their_dh)
+func (e *Entity) sendP2() (Msg, error) {
+	if e.version == '3' {
+		return e.sendDHKey(), nil
+	}
+	if e.pending == nil {
+		return Msg{}, errNoDAKE
+	}
+	priv, pub := e.generateKeys()
+	secret, err := e.computeSecret(priv, e.pending.their_dh)
+	if err != nil {
+		return Msg{}, err
+	}
+	if e.usesBrace() {
+		if err := e.refreshBrace(e.pending); err != nil {
+			return Msg{}, err
+		}
+	}
+	e.pending.our_dh_priv, e.pending.our_dh_pub = priv, pub
 	e.pending.derive(secret[:])
 	e.pending.j = 0 // she will ratchet when sending next
 
-	toSend := Msg{P2, e.name, -1, -1, e.pending.our_dh_pub, nil, e.ssid + 1}
-	fmt.Printf("%s \tsending P2 %d\n", e.name, toSend.ssid)
-	e.AuthState = AUTHSTATE_NONE
-	return toSend
+	toSend := Msg{mtype: P2, sender: e.name, rid: -1, mid: -1, dh: e.pending.our_dh_pub, ssid: e.ssid + 1, profile: e.profile(),
+		kemEk: e.pending.sent_kem_ek, kemCt: e.pending.sent_kem_ct, dh3072: e.pending.sent_dh3072}
+	toSend.sig = e.provider().sign(e.our_identity_priv, e.pending.transcriptWith(toSend))
+	e.traceMsg(EVENT_SEND, toSend)
+	e.setAuthState(AUTHSTATE_NONE)
+	e.dropLegacy()
+	e.setMsgState(MSGSTATE_ENCRYPTED)
+	if e.resyncing {
+		e.switchKeychain() // the keys we have are out of sync anyway
+	}
+	e.retryUnread()
+	return toSend, nil
 }
 
 func (e *Entity) receiveP2(m Msg) {
-	fmt.Printf("%s \treceive P2 %d\n", e.name, m.ssid)
+	if e.pending == nil {
+		e.reject(errNoDAKE)
+		return
+	}
+	if !e.provider().verify(m.sig, e.pending.transcriptWith(m), m.profile.identity) {
+		e.reject(errDAKESignature)
+		return
+	}
+	secret, err := e.computeSecret(e.pending.our_dh_priv, m.dh)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	if e.usesBrace() {
+		if err := e.pending.followBrace(m); err != nil {
+			e.reject(err)
+			return
+		}
+	}
+	e.their_profile = m.profile
 	e.pending.their_dh = m.dh
-	secret := c.ComputeSecret(e.pending.our_dh_priv, e.pending.their_dh)
 	e.pending.derive(secret[:])
 
 	e.pending.j = 1 // so he does not ratchet
 
-	// switch to new keychain
-	e.previous = e.current
-	e.current = e.pending
-	e.pending = nil
-	e.ssid = e.ssid + 1
-
-	e.AuthState = AUTHSTATE_NONE
+	e.adoptSSID(m.ssid)
+	e.switchKeychain()
+	e.setAuthState(AUTHSTATE_NONE)
+	e.dropLegacy()
+	e.setMsgState(MSGSTATE_ENCRYPTED)
+	e.retryUnread()
 }
 
 func (e *Entity) receiveData(m Msg) {
-	fmt.Printf("%s \treceive D %d %d %d\n", e.name, m.ssid, m.rid, m.mid)
-	ck := make([]byte, 64)
+	if !e.readData(m) {
+		e.resyncIfStuck()
+	}
+}
+
+// readData tells whether we could read m.
+func (e *Entity) readData(m Msg) bool {
+	if e.waitsForDAKE(m) {
+		e.bufferUnread(m)
+		return false
+	}
+	if e.msgState != MSGSTATE_ENCRYPTED {
+		e.rejectWithError(errNotEncrypted, ERROR_NOT_PRIVATE)
+		return false
+	}
+	if e.legacy != nil || m.v3 != nil {
+		e.receiveLegacyData(m)
+		return false
+	}
+	if m.rid < 0 || m.mid < 0 {
+		e.reject(errBadMessageID)
+		return false
+	}
 
 	var kc *keychain
 	if m.ssid == e.ssid {
 		kc = e.current
-	} else if m.ssid == e.ssid+1 {
-		fmt.Printf("%s \tFirst msg ACK...\n", e.name)
-		// switch to new keychain
-		e.previous = e.current
-		e.current = e.pending
-		e.pending = nil
-		e.ssid = e.ssid + 1
-
-		kc = e.current
+	} else if m.ssid == e.ssid+1 && e.pending != nil {
+		kc = e.pending // the first msg ACKs it, if authentic
 	} else if m.ssid == e.ssid-1 {
 		kc = e.previous
 	}
-	if m.rid == kc.rid+1 {
-		fmt.Printf("%s \tFollow Ratcheting...\n", e.name)
+	// Until m is authentic, it may be forged: whatever is wrong with it, we
+	// drop it, and the peer does not hear from us.
+	if kc == nil && m.ssid > e.ssid {
+		e.reject(errUnknownSession)
+		e.keepUnread(m)
+		return false
+	}
+	if kc == nil {
+		e.reject(errUnknownSession)
+		return false
+	}
+	if kc.expired(m.rid) {
+		e.reject(errExpiredKey)
+		return false
+	}
+	if m.rid > kc.rid+1 {
+		e.reject(errRatchetGap)
+		e.keepUnread(m)
+		return false
+	}
 
-		kc.rid = m.rid
-		kc.their_dh = m.dh
-		secret := c.ComputeSecret(kc.our_dh_priv, kc.their_dh)
-		kc.derive(secret[:])
-		kc.j = 0 // need to ratchet next time when send
+	// We work on a copy of kc until we know m is authentic, so that a forged
+	// message can not move our ratchet. Following a ratchet takes a DH before
+	// we can tell, once per message at most.
+	next := *kc
+	follows := m.rid == next.rid+1
+	// any message of a new ratchet starts it for us, as they all carry its
+	// dh: the first one may be lost or late
+	if follows {
+		next.rid = m.rid
+		next.their_dh = m.dh
+		secret, err := e.computeSecret(next.our_dh_priv, next.their_dh)
+		if err != nil {
+			e.reject(err)
+			return false
+		}
+		if next.brace != nil {
+			if err := next.followBrace(m); err != nil {
+				e.reject(err)
+				return false
+			}
+		}
+		next.derive(secret[:])
+		next.j = 0 // need to ratchet next time when send
+	}
+	if max := e.limits.maxSkipped(); max >= 0 && m.mid-next.received[m.rid]-1 > max {
+		e.reject(errMessageJump)
+		return false
 	}
 
+	ck := next.retriveChainkey(m.rid, m.mid)
+	if !m.decryptWith(ck) {
+		e.traceMsg(EVENT_DECRYPT_FAIL, m)
+		e.keepUnread(m)
+		return false
+	}
+	plaintext, ok := e.decrypt(m, ck)
+	if !ok {
+		e.traceMsg(EVENT_DECRYPT_FAIL, m)
+		return false
+	}
+
+	*kc = next
+	e.unreadSince = time.Time{} // we read the peer again
+	if kc == e.pending {
+		e.switchKeychain()
+	}
+	if follows {
+		e.trace(event{kind: EVENT_FOLLOW_RATCHET, ssid: m.ssid, rid: kc.rid})
+	}
 	kc.k = m.mid
-	ck = kc.retriveChainkey(m.rid, m.mid)
+	if m.mid > kc.received[m.rid] {
+		kc.received[m.rid] = m.mid
+	}
+	e.traceMsg(EVENT_DECRYPT_OK, m)
+	e.macsToReveal = append(e.macsToReveal, kc.macKey(ck))
+
+	tlvs, err := decodeTLVs(plaintext)
+	if err != nil {
+		e.rejectWithError(err, ERROR_MALFORMED)
+		return false
+	}
+	e.receiveTLVs(tlvs, m.ssid, kc, ck)
 
-	m.decryptWith(ck)
+	if e.msgState == MSGSTATE_FINISHED {
+		e.wipeSession() // the peer ended it
+		return true
+	}
+	if e.heartbeat > 0 && e.now().Sub(e.lastSent) >= e.heartbeat {
+		e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "heartbeat"})
+		e.queueData()
+	}
+	return true
 }
 
-func (e *Entity) sendData() Msg {
-	if e.current == nil {
-		// switch to new keychain
-		e.current = e.pending
-		e.pending = nil
-		e.ssid = e.ssid + 1
+func (e *Entity) sendData() (Msg, error) {
+	if err := e.readyToSend(); err != nil {
+		return Msg{}, err
+	}
+	plaintext, err := encodeTLVs(padTLVs(e.outgoing, e.padding))
+	if err != nil {
+		return Msg{}, err
+	}
+	if e.legacy != nil {
+		return e.sendLegacyData(plaintext), nil
 	}
 	var cj key
 	if e.current.j == 0 {
-		fmt.Printf("%s \tRatcheting...\n", e.name)
-
-		e.current.our_dh_priv, e.current.our_dh_pub, _ = c.GenerateKeys()
-		secret := c.ComputeSecret(e.current.our_dh_priv, e.current.their_dh)
-		e.current.rid += 1
-		e.current.derive(secret[:])
+		// a copy again, so that a failure leaves our ratchet alone
+		next := *e.current
+		next.our_dh_priv, next.our_dh_pub = e.generateKeys()
+		secret, err := e.computeSecret(next.our_dh_priv, next.their_dh)
+		if err != nil {
+			return Msg{}, err
+		}
+		next.rid += 1
+		if next.brace != nil {
+			if err := e.refreshBrace(&next); err != nil {
+				return Msg{}, err
+			}
+		}
+		next.derive(secret[:])
+		*e.current = next
+		e.trace(event{kind: EVENT_RATCHET, ssid: e.ssid, rid: e.current.rid})
 	}
 
 	cj = e.current.retriveChainkey(e.current.rid, e.current.j)
-	toSend := Msg{D, e.name, e.current.rid, e.current.j, e.current.our_dh_pub, cj, e.ssid}
+	toSend := Msg{mtype: D, sender: e.name, rid: e.current.rid, mid: e.current.j, dh: e.current.our_dh_pub, encKey: cj, ciphertext: e.provider().seal(cj, plaintext), ssid: e.ssid,
+		kemEk: e.current.sent_kem_ek, kemCt: e.current.sent_kem_ct, dh3072: e.current.sent_dh3072, revealed: e.macsToReveal}
 	e.current.j += 1
+	e.recordSent(e.current, e.outgoing)
+	e.outgoing = nil
+	e.macsToReveal = nil
+	e.lastSent = e.now()
 
-	fmt.Printf("%s \tsending D %d %d %d\n", e.name, toSend.ssid, toSend.rid, toSend.mid)
-	return toSend
+	e.traceMsg(EVENT_SEND, toSend)
+	return toSend, nil
+}
+
+// readyToSend gets the keychain we send in: the one of the DAKE we answered,
+// if we did not send in it yet. It fails when we have none.
+func (e *Entity) readyToSend() error {
+	if e.msgState != MSGSTATE_ENCRYPTED {
+		return errNoSession
+	}
+	if e.legacy != nil {
+		return nil
+	}
+	e.expireKeys()
+	e.resyncIfStuck()
+	if e.current == nil {
+		if e.pending == nil || !e.pending.ready() {
+			return errNoSession
+		}
+		e.switchKeychain()
+	}
+	return nil
+}
+
+// queueData sends a data message of our own through the outbox.
+func (e *Entity) queueData() {
+	m, err := e.sendData()
+	if err != nil {
+		e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "could not send: " + err.Error()})
+		return
+	}
+	e.outbox = append(e.outbox, m)
+}
+
+// currentRid is the rid of our session, or -1 when we have none.
+func (e *Entity) currentRid() int {
+	if e.current == nil {
+		return -1
+	}
+	return e.current.rid
 }
 
 func (e *keychain) wasAliceAt(rid int) bool {
@@ -212,7 +799,7 @@ func (e *keychain) retriveChainkey(rid, mid int) key {
 	}
 	copy(buf, ck)
 	for i := mid; i > 0; i-- {
-		sha3.ShakeSum256(buf, buf)
+		e.kdf(buf, buf)
 	}
 	return buf
 }
@@ -221,19 +808,57 @@ func (e *keychain) derive(secret []byte) {
 	r := make([]byte, 64)
 	ca := make([]byte, 64)
 	cb := make([]byte, 64)
-	if len(e.R) > e.rid {
+	if len(e.R) > 0 {
 		secret = append(secret, e.R[e.rid-1]...)
 	}
-	sha3.ShakeSum256(r, append(secret, 0))
-	sha3.ShakeSum256(ca, append(secret, 1))
-	sha3.ShakeSum256(cb, append(secret, 2))
+	if e.brace != nil {
+		secret = append(secret, e.brace...)
+	}
+	e.kdf(r, append(secret, 0))
+	e.kdf(ca, append(secret, 1))
+	e.kdf(cb, append(secret, 2))
 
 	e.R = append(e.R, r)
 	e.Ca = append(e.Ca, ca)
 	e.Cb = append(e.Cb, cb)
+	e.received = append(e.received, -1)
+	e.ratchetedAt = append(e.ratchetedAt, timeOn(e.clock))
+}
+
+// deriveVector runs derive as in the first ratchet after one whose root key
+// was prevRoot, or as in the DAKE when there is none.
+func deriveVector(secret, prevRoot key) (r, ca, cb key) {
+	e := new(keychain)
+	if prevRoot != nil {
+		e.R = []key{prevRoot}
+		e.rid = 1
+	}
+	e.derive(append(key{}, secret...))
+
+	return e.R[len(e.R)-1], e.Ca[len(e.Ca)-1], e.Cb[len(e.Cb)-1]
+}
+
+// chainKeyVector runs retriveChainkey on a chain starting at ck.
+func chainKeyVector(ck key, mid int) key {
+	e := &keychain{Ca: []key{nil, ck}}
+	return e.retriveChainkey(1, mid)
+}
+
+// scenarioSends are the sends a scenario step can do. A send which fails
+// panics, and so fails the step.
+var scenarioSends = map[string]func(e *Entity) Msg{
+	"query":    (*Entity).query,
+	"sendP1":   (*Entity).sendP1,
+	"sendP2":   func(e *Entity) Msg { return mustSend(e.sendP2()) },
+	"sendData": func(e *Entity) Msg { return mustSend(e.sendData()) },
 }
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	defer closeTrace()
+
 	var a, b *Entity
 
 	fmt.Println("=========================")
@@ -254,6 +879,26 @@ func main() {
 
 	testAsyncDataMessages(runFreshDAKE())
 
+	fmt.Println("=========================")
+	fmt.Println("Testing lost first message of a ratchet")
+	fmt.Println("=========================")
+
+	testLostFirstMessage(runFreshDAKE())
+	testLateFirstMessage(runFreshDAKE())
+	a, b = runFreshDAKE()
+	testLostFirstMessage(b, a)
+	testLateFirstMessage(b, a)
+
+	// the brace key refreshes ride on every message of a ratchet too
+	a, b = initialize()
+	a.mixDH, b.mixDH = true, true
+	a.braceEvery, b.braceEvery = 1, 1
+	testSyncDAKE(a, b)
+	for i := 0; i < dh3072Every; i++ {
+		testLostFirstMessage(a, b)
+		testLateFirstMessage(b, a)
+	}
+
 	fmt.Println("=========================")
 	fmt.Println("Testing new sync DAKE")
 	fmt.Println("=========================")
@@ -273,7 +918,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	a.receive(b.sendData()) //Make sure late msg is a follow up
+	a.receive(mustSend(b.sendData())) //Make sure late msg is a follow up
 	testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKE(a, b)
 	testSyncDataMessages(a, b) // Alice should ratchet because she sends first
 
@@ -281,7 +926,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	a.receive(b.sendData()) //Make sure late msg is a follow up
+	a.receive(mustSend(b.sendData())) //Make sure late msg is a follow up
 	testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKE(a, b)
 	testSyncDataMessages(b, a) // Bob should not ratchet because he sends first
 
@@ -293,7 +938,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	b.receive(a.sendData()) //Make sure late msg is a new RATCHET
+	b.receive(mustSend(a.sendData())) //Make sure late msg is a new RATCHET
 	testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKE(a, b)
 	testSyncDataMessages(a, b) // Alice should ratchet because she sends first
 
@@ -301,7 +946,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	b.receive(a.sendData()) //Make sure late msg is a new RATCHET
+	b.receive(mustSend(a.sendData())) //Make sure late msg is a new RATCHET
 	testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKE(a, b)
 	testSyncDataMessages(b, a) // Bob should not ratchet because he sends first
 
@@ -313,7 +958,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	a.receive(b.sendData()) //Make sure late msg is a follow up
+	a.receive(mustSend(b.sendData())) //Make sure late msg is a follow up
 	testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKEAfterSheRatchetsAgain(a, b)
 	testSyncDataMessages(a, b) // Alice should ratchet because she sends first
 
@@ -321,7 +966,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	a.receive(b.sendData()) //Make sure late msg is a new RATCHET
+	a.receive(mustSend(b.sendData())) //Make sure late msg is a new RATCHET
 	testAsyncDAKE_BobSendP1ButAliceNeverRecieveP1(a, b)
 	testSyncDataMessages(a, b) // Alice should ratchet because she sends first
 
@@ -333,7 +978,7 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	a.receive(b.sendData()) //Make sure late msg is a follow up
+	a.receive(mustSend(b.sendData())) //Make sure late msg is a follow up
 	testAsyncDAKE_AliceReceivesLateNewRathcetMsgFromPreviousDAKE(a, b)
 	testSyncDataMessages(a, b) // Alice should ratchet because she sends first
 
@@ -341,10 +986,153 @@ func main() {
 	testSyncDataMessages(a, b)
 
 	//B will send a late msg during a new DAKE.
-	a.receive(b.sendData()) //Make sure late msg is a new RATCHET
+	a.receive(mustSend(b.sendData())) //Make sure late msg is a new RATCHET
 	testAsyncDAKE_AliceReceivesLateNewRathcetMsgFromPreviousDAKE(a, b)
 	testSyncDataMessages(a, b) // Alice should ratchet because she sends first
 
+	fmt.Println("=========================")
+	fmt.Println("Testing non-interactive DAKE")
+	fmt.Println("=========================")
+
+	server := newPrekeyServer(1)
+	testPrekeyServer(server, server)
+
+	l, err := listenPrekeyServer(newPrekeyServer(1), "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	testPrekeyServer(prekeyClient{"http://" + l.Addr().String()}, nil)
+	l.Close()
+
+	testSyncDataMessages(testNonInteractiveDAKE(initialize()))
+
+	a, b = runFreshDAKE()
+	testSyncDataMessages(a, b)
+	testNonInteractiveDAKE(a, b) // Alice keeps sending in the old keychain until Bob replies
+	testSyncDataMessages(a, b)
+
+	testNonInteractiveRejects()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing client profiles")
+	fmt.Println("=========================")
+
+	testClientProfiles()
+	testProfileBinding()
+	testTransitionalClientProfile()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing brace key")
+	fmt.Println("=========================")
+
+	a, b = initialize()
+	a.braceEvery, b.braceEvery = 3, 3
+	testBraceKey(testSyncDAKE(a, b))
+
+	a, b = initialize()
+	a.braceEvery, b.braceEvery = 3, 3
+	testBraceKey(testNonInteractiveDAKE(a, b))
+
+	testBadBraceKeys()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing crypto provider")
+	fmt.Println("=========================")
+
+	testCountingProvider()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing X448 point validation")
+	fmt.Println("=========================")
+
+	testPointValidation()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing mixed 3072-bit DH")
+	fmt.Println("=========================")
+
+	a, b = initialize()
+	a.mixDH, b.mixDH = true, true
+	testMixedDH(testSyncDAKE(a, b))
+
+	a, b = initialize()
+	a.mixDH, b.mixDH = true, true
+	a.braceEvery, b.braceEvery = 2, 2
+	testMixedDH(testSyncDAKE(a, b))
+
+	fmt.Println("=========================")
+	fmt.Println("Testing SMP")
+	fmt.Println("=========================")
+
+	testSMP(testSyncDAKE(initialize()))
+
+	fmt.Println("=========================")
+	fmt.Println("Testing TLVs")
+	fmt.Println("=========================")
+
+	testTLVs(testSyncDAKE(initialize()))
+
+	fmt.Println("=========================")
+	fmt.Println("Testing extra symmetric key")
+	fmt.Println("=========================")
+
+	testExtraKey(testSyncDAKE(initialize()))
+	testExtraKey(testNonInteractiveDAKE(initialize()))
+
+	fmt.Println("=========================")
+	fmt.Println("Testing message state")
+	fmt.Println("=========================")
+
+	testMsgState()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing end session")
+	fmt.Println("=========================")
+
+	testEndSession(testSyncDAKE(initialize()))
+
+	fmt.Println("=========================")
+	fmt.Println("Testing heartbeats")
+	fmt.Println("=========================")
+
+	testHeartbeats(testSyncDAKE(initialize()))
+
+	fmt.Println("=========================")
+	fmt.Println("Testing key expiry")
+	fmt.Println("=========================")
+
+	testKeyExpiry()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing version negotiation")
+	fmt.Println("=========================")
+
+	testVersionNegotiation()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing OTRv3 sessions")
+	fmt.Println("=========================")
+
+	testLegacySession()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing error messages")
+	fmt.Println("=========================")
+
+	testErrorMessages()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing resync")
+	fmt.Println("=========================")
+
+	testResync()
+
+	fmt.Println("=========================")
+	fmt.Println("Testing ratchet limits")
+	fmt.Println("=========================")
+
+	testRatchetLimits()
+
 	//
 	// OLD TEST
 	//
@@ -352,24 +1140,24 @@ func main() {
 	a, b = initialize()
 	b.receive(a.query())
 	a.receive(b.sendP1())
-	b.receive(a.sendP2())
+	b.receive(mustSend(a.sendP2()))
 
 	fmt.Println("=========================")
 	fmt.Println("Testing sync data message")
 	fmt.Println("=========================")
 
-	a.receive(b.sendData()) // b sends first, so no new ratchet happens.
-	a.receive(b.sendData()) // b again: this is another follow up msg.
-	b.receive(a.sendData()) // a sends, a new ratchet happens and bob follows.
-	b.receive(a.sendData()) // a again: this is a follow up.
+	a.receive(mustSend(b.sendData())) // b sends first, so no new ratchet happens.
+	a.receive(mustSend(b.sendData())) // b again: this is another follow up msg.
+	b.receive(mustSend(a.sendData())) // a sends, a new ratchet happens and bob follows.
+	b.receive(mustSend(a.sendData())) // a again: this is a follow up.
 
 	fmt.Println("=========================")
 	fmt.Println("Testing async data message")
 	fmt.Println("=========================")
 
-	m1 := a.sendData() // a sends again: another follow up message.
-	m2 := b.sendData() // b sends now, a new ratcher happens for bob.
-	m3 := a.sendData() // a sends again: another follow up message.
+	m1 := mustSend(a.sendData()) // a sends again: another follow up message.
+	m2 := mustSend(b.sendData()) // b sends now, a new ratcher happens for bob.
+	m3 := mustSend(a.sendData()) // a sends again: another follow up message.
 
 	b.receive(m1) // b receives follow up message from a previous ratchet.
 	b.receive(m3) // b receives follow up message from a previous ratchet.
@@ -381,31 +1169,31 @@ func main() {
 
 	b.receive(a.query())
 	a.receive(b.sendP1())
-	b.receive(a.sendP2())
+	b.receive(mustSend(a.sendP2()))
 
-	b.receive(a.sendData()) // a sends, a new ratchet starts and bob follows
-	b.receive(a.sendData()) // a sends a follow up
-	a.receive(b.sendData()) // b sends, a new ratchet starts and alice follows
-	a.receive(b.sendData()) // b sends a follow up
+	b.receive(mustSend(a.sendData())) // a sends, a new ratchet starts and bob follows
+	b.receive(mustSend(a.sendData())) // a sends a follow up
+	a.receive(mustSend(b.sendData())) // b sends, a new ratchet starts and alice follows
+	a.receive(mustSend(b.sendData())) // b sends a follow up
 
 	fmt.Println("=========================")
 	fmt.Println("Testing async DAKE message")
 	fmt.Println("=========================")
 
-	a.receive(b.sendData()) // make sure b0 is a follow up
+	a.receive(mustSend(b.sendData())) // make sure b0 is a follow up
 
 	b.receive(a.query())
 	p1 := b.sendP1()
-	b0 := b.sendData() // bob sends a data message during a new DAKE, is this a follow up msg?
-	b1 := b.sendData() // bob sends a data message during a new DAKE - surely a follow up msg.
+	b0 := mustSend(b.sendData()) // bob sends a data message during a new DAKE, is this a follow up msg?
+	b1 := mustSend(b.sendData()) // bob sends a data message during a new DAKE - surely a follow up msg.
 
 	//FIXME
-	b.receive(a.sendData()) // a sends a new message before she receives p1, but after bob sends p1.
+	b.receive(mustSend(a.sendData())) // a sends a new message before she receives p1, but after bob sends p1.
 	// this will be a new ratchet, and thats a problem because bob will also ratchet when sending p1.
 
-	a.receive(p1)      // a receives p1
-	p2 := a.sendP2()   // ... and immediately replies with a p2
-	a0 := a.sendData() // ... and send a new data msg
+	a.receive(p1)                // a receives p1
+	p2 := mustSend(a.sendP2())   // ... and immediately replies with a p2
+	a0 := mustSend(a.sendData()) // ... and send a new data msg
 
 	b.receive(p2) // bob receives a p2
 	b.receive(a0) // and the a0
@@ -414,10 +1202,10 @@ func main() {
 	a.receive(b1) // a receives b1
 
 	// After delayed messages, happy path
-	a.receive(b.sendData()) // b sends, a new ratchet starts and alice follows
-	a.receive(b.sendData()) // b sends a follow up
-	b.receive(a.sendData()) // a sends, a new ratchet starts and bob follows
-	b.receive(a.sendData()) // a sends a follow up
+	a.receive(mustSend(b.sendData())) // b sends, a new ratchet starts and alice follows
+	a.receive(mustSend(b.sendData())) // b sends a follow up
+	b.receive(mustSend(a.sendData())) // a sends, a new ratchet starts and bob follows
+	b.receive(mustSend(a.sendData())) // a sends a follow up
 
 }
 
@@ -439,29 +1227,105 @@ func runFreshDAKE() (a, b *Entity) {
 func testSyncDAKE(a, b *Entity) (*Entity, *Entity) {
 	b.receive(a.query())
 	a.receive(b.sendP1())
-	b.receive(a.sendP2())
+	b.receive(mustSend(a.sendP2()))
 
 	return a, b
 }
 
+// must panics on the error of a call which should not fail.
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// mustSend is the message of a send which should not fail.
+func mustSend(m Msg, err error) Msg {
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// expectPanic runs f, which should panic with want.
+func expectPanic(want string, f func()) {
+	defer func() {
+		if r := recover(); r != want {
+			panic(fmt.Sprintf("expected to panic with %q, got %v", want, r))
+		}
+	}()
+	f()
+}
+
+// deliverOutbox hands what from sent by itself to to, until neither has
+// anything left to say.
+func deliverOutbox(from, to *Entity) {
+	for {
+		out := from.takeOutbox()
+		if len(out) == 0 {
+			return
+		}
+		for _, m := range out {
+			to.receive(m)
+		}
+		from, to = to, from
+	}
+}
+
+func countEvents(rec *recordTracer, kind eventType) int {
+	n := 0
+	for _, ev := range rec.events {
+		if ev.kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
 func testSyncDataMessages(a, b *Entity) {
-	a.receive(b.sendData()) // b sends first, so no new ratchet happens.
-	a.receive(b.sendData()) // b again: this is another follow up msg.
-	b.receive(a.sendData()) // a sends, a new ratchet happens and bob follows.
-	b.receive(a.sendData()) // a again: this is a follow up.
+	a.receive(mustSend(b.sendData())) // b sends first, so no new ratchet happens.
+	a.receive(mustSend(b.sendData())) // b again: this is another follow up msg.
+	b.receive(mustSend(a.sendData())) // a sends, a new ratchet happens and bob follows.
+	b.receive(mustSend(a.sendData())) // a again: this is a follow up.
 }
 
 func testAsyncDataMessages(a, b *Entity) {
-	b.receive(a.sendData()) // enforce m1 is a follow up
-	m1 := a.sendData()      // a sends again: another follow up message.
-	m2 := b.sendData()      // b sends now, a new ratcher happens for bob.
-	m3 := a.sendData()      // a sends again: another follow up message.
+	b.receive(mustSend(a.sendData())) // enforce m1 is a follow up
+	m1 := mustSend(a.sendData())      // a sends again: another follow up message.
+	m2 := mustSend(b.sendData())      // b sends now, a new ratcher happens for bob.
+	m3 := mustSend(a.sendData())      // a sends again: another follow up message.
 
 	b.receive(m1) // b receives follow up message from a previous ratchet.
 	b.receive(m3) // b receives follow up message from a previous ratchet.
 	a.receive(m2) // a receives a message from a new ratchet. She follows the ratchet.
 }
 
+// testLostFirstMessage has b lose the first message of the new ratchet of a.
+// The next one carries the same dh, so b follows the ratchet from it.
+func testLostFirstMessage(a, b *Entity) {
+	a.receive(mustSend(b.sendData())) // so that a starts a new ratchet next
+	rid := b.currentRid()
+	mustSend(a.sendData()) // lost
+	b.receive(mustSend(a.sendData()))
+	if b.currentRid() != rid+1 {
+		panic("should follow a ratchet from any of its messages")
+	}
+	a.receive(mustSend(b.sendData())) // b starts a new ratchet, a follows it
+}
+
+// testLateFirstMessage has the first message of the new ratchet of a arrive
+// after a later one, and after b sent in the ratchet following it.
+func testLateFirstMessage(a, b *Entity) {
+	a.receive(mustSend(b.sendData())) // so that a starts a new ratchet next
+	m0 := mustSend(a.sendData())
+	m1 := mustSend(a.sendData())
+	b.receive(m1)                // b follows the ratchet from its second message
+	m2 := mustSend(b.sendData()) // b starts a new ratchet
+	b.receive(m0)                // and still derives the key of the skipped one
+	a.receive(m2)
+	testSyncDataMessages(a, b)
+}
+
 // NOTE The late message may or may not be a follow up.
 // NOTE Bob does not receive any message after starting the DAKE.
 // NOTE Bob does not receive any late messages after both finish the DAKE.
@@ -470,12 +1334,12 @@ func testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKE(a, b *Entity) {
 	p1 := b.sendP1()
 
 	// Bob sends a message which wiill be delivered late. It can be a follow up or not.
-	late := b.sendData()
+	late := mustSend(b.sendData())
 
 	// NOTE Bob does not receive any message after starting the DAKE.
 
-	a.receive(p1)    // a receives p1
-	p2 := a.sendP2() // ... and immediately replies with a p2. The DAKE finishes for Alice.
+	a.receive(p1)              // a receives p1
+	p2 := mustSend(a.sendP2()) // ... and immediately replies with a p2. The DAKE finishes for Alice.
 
 	// Alice receives the late message after finishing the DAKE
 	a.receive(late)
@@ -496,16 +1360,16 @@ func testAsyncDAKE_AliceReceivesLateMsgFromPreviousDAKEAfterSheRatchetsAgain(a,
 	p1 := b.sendP1()
 
 	// Bob sends a message which wiill be delivered late. It can be a follow up or not.
-	late := b.sendData()
+	late := mustSend(b.sendData())
 
-	b.receive(a.sendData()) // Alice starts a NEW ratchet.
+	b.receive(mustSend(a.sendData())) // Alice starts a NEW ratchet.
 
 	// NOTE Bob does not receive any message after starting the DAKE.
 
-	a.receive(p1)    // a receives p1
-	p2 := a.sendP2() // ... and immediately replies with a p2. The DAKE finishes for Alice.
+	a.receive(p1)              // a receives p1
+	p2 := mustSend(a.sendP2()) // ... and immediately replies with a p2. The DAKE finishes for Alice.
 
-	late_from_receiver := a.sendData() // This should make Alice ratchet
+	late_from_receiver := mustSend(a.sendData()) // This should make Alice ratchet
 
 	// Alice receives the late message after finishing the DAKE
 	a.receive(late)
@@ -525,15 +1389,15 @@ func testAsyncDAKE_BobSendP1ButAliceNeverRecieveP1(a, b *Entity) {
 	p1 := b.sendP1()
 
 	// Bob sends a message which will be delivered late. It can be a follow up or not.
-	late := b.sendData()
+	late := mustSend(b.sendData())
 
-	b.receive(a.sendData()) // Alice starts a NEW ratchet.
+	b.receive(mustSend(a.sendData())) // Alice starts a NEW ratchet.
 
 	// NOTE Bob does not receive any message after starting the DAKE.
 
 	a.receive(p1) // a receives p1
-	b.receive(a.sendP2())
-	b.receive(a.sendData())
+	b.receive(mustSend(a.sendP2()))
+	b.receive(mustSend(a.sendData()))
 	a.receive(late)
 
 	ridOfBob := b.current.rid
@@ -541,12 +1405,12 @@ func testAsyncDAKE_BobSendP1ButAliceNeverRecieveP1(a, b *Entity) {
 	b.receive(a.query())
 	b.sendP1()
 
-	a.receive(b.sendData())
-	a.receive(b.sendData())
-	b.receive(a.sendData())
-	b.receive(a.sendData())
-	a.receive(b.sendData())
-	a.receive(b.sendData())
+	a.receive(mustSend(b.sendData()))
+	a.receive(mustSend(b.sendData()))
+	b.receive(mustSend(a.sendData()))
+	b.receive(mustSend(a.sendData()))
+	a.receive(mustSend(b.sendData()))
+	a.receive(mustSend(b.sendData()))
 
 	if b.current.rid <= ridOfBob {
 		panic("bob should ratchet even when alice not receiving p1")
@@ -560,13 +1424,13 @@ func testAsyncDAKE_AliceReceivesLateNewRathcetMsgFromPreviousDAKE(a, b *Entity)
 	b.receive(a.query())
 	p1 := b.sendP1()
 
-	late := b.sendData()    // Bob sends late. Can be NEW ratchet or follow up.
-	b.receive(a.sendData()) // Bob receives from Alice. If "late" is a follow up, this is a NEW ratchet. This is a follow up otherwise.
-	late2 := b.sendData()   // Bob sends late2. This is always a NEW dake (he has just receive something from Alice).
-	b.receive(a.sendData()) // Alice sends a follow up (she hasnt received anything from Bob), since her last message.
+	late := mustSend(b.sendData())    // Bob sends late. Can be NEW ratchet or follow up.
+	b.receive(mustSend(a.sendData())) // Bob receives from Alice. If "late" is a follow up, this is a NEW ratchet. This is a follow up otherwise.
+	late2 := mustSend(b.sendData())   // Bob sends late2. This is always a NEW dake (he has just receive something from Alice).
+	b.receive(mustSend(a.sendData())) // Alice sends a follow up (she hasnt received anything from Bob), since her last message.
 
-	a.receive(p1)    // a receives p1
-	p2 := a.sendP2() // ... and immediately replies with a p2. The DAKE finishes for Alice.
+	a.receive(p1)              // a receives p1
+	p2 := mustSend(a.sendP2()) // ... and immediately replies with a p2. The DAKE finishes for Alice.
 
 	// AKE finishes for Bob.
 	b.receive(p2)
@@ -0,0 +1,141 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// rejectWithError drops a data message we can not read, and tells the peer
+// so.
+func (e *Entity) rejectWithError(err error, code errorCode) {
+	e.reject(err)
+	e.sendError(code)
+}
+
+// sendError sends an error message through our outbox. We keep quiet about
+// the messages we buffered: we told the peer about those when we resynced.
+func (e *Entity) sendError(code errorCode) {
+	if e.replaying {
+		return
+	}
+	toSend := Msg{mtype: ERR, sender: e.name, text: errorText(code)}
+	e.traceMsg(EVENT_SEND, toSend)
+	e.outbox = append(e.outbox, toSend)
+}
+
+// receiveError tells the user what went wrong. If the policy says so, we
+// also start a new DAKE, in case our keys got out of sync with the peer.
+func (e *Entity) receiveError(m Msg) {
+	if _, ok := parseErrorText(m.text); !ok {
+		e.reject(errors.New("malformed error message"))
+		return
+	}
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "peer: " + m.text})
+	if e.policy.errorStartAKE {
+		e.outbox = append(e.outbox, e.query())
+	}
+}
+
+// testErrorMessages has Bob tell Alice about data messages he can not read,
+// and Alice start a new DAKE when her policy says so.
+func testErrorMessages() {
+	a, b := runFreshDAKE()
+	testSyncDataMessages(a, b)
+	rec := &recordTracer{}
+	a.tracer = rec
+	expectError := func(code errorCode, why string) []Msg {
+		out := b.takeOutbox()
+		if len(out) == 0 || out[0].mtype != ERR {
+			panic(why + ": should send an error message")
+		}
+		if got, ok := parseErrorText(out[0].text); !ok || got != code {
+			panic(why + ": should send " + errorText(code) + ", got " + out[0].text)
+		}
+		a.receive(out[0])
+		return out[1:]
+	}
+
+	// a message which fails to authenticate may be forged: Bob keeps quiet
+	tampered := mustSend(a.sendData())
+	tampered.ciphertext = append([]byte{}, tampered.ciphertext...)
+	tampered.ciphertext[0] ^= 1
+	b.receive(tampered)
+	if len(b.takeOutbox()) != 0 {
+		panic("should not answer a message which may be forged")
+	}
+
+	garbage := mustSend(a.sendData())
+	garbage.ciphertext = a.provider().seal(garbage.encKey, []byte{0, 1})
+	b.receive(garbage)
+	if rest := expectError(ERROR_MALFORMED, "garbage TLVs"); len(rest) != 0 || len(a.takeOutbox()) != 0 {
+		panic("should not start a DAKE unless the policy says so")
+	}
+	if a.msgState != MSGSTATE_ENCRYPTED || b.msgState != MSGSTATE_ENCRYPTED {
+		panic("error messages should not change the state")
+	}
+
+	// when Bob could not read Alice for a while, he tells her and starts a
+	// new DAKE
+	clock := &fakeClock{time.Unix(0, 0)}
+	b.clock = clock
+	b.resyncAfter = time.Minute
+	unknown := func() Msg {
+		m := mustSend(a.sendData())
+		m.ssid += 2
+		return m
+	}
+	b.receive(unknown())
+	clock.advance(time.Minute)
+	b.receive(mustSend(a.sendData()))
+	if len(b.takeOutbox()) != 0 || b.resyncing {
+		panic("should not start a DAKE when it reads the peer again")
+	}
+	b.receive(unknown())
+	clock.advance(time.Minute)
+	b.receive(unknown())
+	rest := expectError(ERROR_UNREADABLE, "unread for a minute")
+	if len(rest) != 1 || rest[0].mtype != Q || len(a.takeOutbox()) != 0 {
+		panic("should start a new DAKE after a minute without reading the peer")
+	}
+	ssid := a.ssid
+	a.receive(rest[0])
+	b.receive(a.sendP1())
+	a.receive(mustSend(b.sendP2()))
+	testSyncDataMessages(a, b)
+	if a.ssid == ssid || a.ssid != b.ssid || b.resyncing {
+		panic("should be in sync again")
+	}
+	b.clock, b.resyncAfter = nil, 0
+
+	// with the policy, Alice answers an error with a query
+	a.policy.errorStartAKE = true
+	b.sendError(ERROR_UNREADABLE)
+	expectError(ERROR_UNREADABLE, "unreadable")
+	ssid = a.ssid
+	deliverOutbox(a, b) // the query
+	a.receive(b.sendP1())
+	b.receive(mustSend(a.sendP2()))
+	testSyncDataMessages(a, b)
+	if a.ssid == ssid || a.ssid != b.ssid || a.msgState != MSGSTATE_ENCRYPTED || b.msgState != MSGSTATE_ENCRYPTED {
+		panic("an error should start a new DAKE")
+	}
+
+	// Bob has no session at all
+	c, d := initialize()
+	d.receive(mustSend(a.sendData()))
+	if out := d.takeOutbox(); len(out) != 1 || out[0].text != errorText(ERROR_NOT_PRIVATE) {
+		panic("should tell the peer there is no private session")
+	}
+	if c.msgState != MSGSTATE_PLAINTEXT || d.msgState != MSGSTATE_PLAINTEXT {
+		panic("error messages should not change the state")
+	}
+
+	a.receive(Msg{mtype: ERR, sender: b.name, text: "?OTR Error: what"})
+	if countEvents(rec, EVENT_REJECT) != 1 {
+		panic("should reject malformed error messages")
+	}
+	a.tracer = nil
+}
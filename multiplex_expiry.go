@@ -0,0 +1,177 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// testHeartbeats has Alice notify Bob, who never writes back.
+func testHeartbeats(a, b *Entity) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	a.clock, b.clock = clock, clock
+	b.heartbeat = time.Minute
+
+	beats := 0
+	notify := func() {
+		clock.advance(25 * time.Second)
+		b.receive(mustSend(a.sendData()))
+		for _, m := range b.takeOutbox() {
+			beats++
+			a.receive(m)
+		}
+	}
+	expectBeats := func(n int, why string) {
+		if beats != n {
+			panic(fmt.Sprintf("%s: expected %d heartbeats, got %d", why, n, beats))
+		}
+	}
+
+	notify()
+	expectBeats(1, "Bob never sent, so he should answer right away")
+	rid := a.current.rid
+	for i := 0; i < 3; i++ {
+		notify()
+	}
+	expectBeats(2, "Bob should send a heartbeat once a minute")
+	if a.current.rid <= rid {
+		panic("Alice should ratchet after a heartbeat")
+	}
+
+	clock.advance(time.Minute)
+	a.receive(mustSend(b.sendData()))
+	notify()
+	expectBeats(2, "Bob should not send a heartbeat when he has just sent")
+
+	// without heartbeats, Alice keeps sending in the same ratchet
+	b.heartbeat = 0
+	rid = a.current.rid
+	for i := 0; i < 10; i++ {
+		notify()
+	}
+	expectBeats(2, "Bob should not send heartbeats when they are off")
+	if a.current.rid != rid {
+		panic("Alice should not ratchet without heartbeats")
+	}
+	a.clock, b.clock = nil, nil
+}
+
+// expireSkipped forgets the chain keys of every ratchet we moved on from
+// lifetime ago. Late messages of those ratchets can not be read anymore.
+func (e *keychain) expireSkipped(now time.Time, lifetime time.Duration) {
+	for rid := 0; rid < e.rid && rid+1 < len(e.ratchetedAt); rid++ {
+		if e.Ca[rid] == nil || now.Sub(e.ratchetedAt[rid+1]) < lifetime {
+			continue
+		}
+		wipeKeys(e.Ca[rid], e.Cb[rid])
+		e.Ca[rid], e.Cb[rid] = nil, nil
+	}
+}
+
+func (e *keychain) expired(rid int) bool {
+	return rid >= 0 && rid < len(e.Ca) && e.Ca[rid] == nil
+}
+
+// expireKeys forgets whatever the expiry policy says we kept for too long.
+func (e *Entity) expireKeys() {
+	now := e.now()
+	expired := func(since time.Time, lifetime time.Duration) bool {
+		return lifetime > 0 && now.Sub(since) >= lifetime
+	}
+
+	if e.pending != nil && expired(e.pending.created, e.expiry.pending) {
+		e.pending.wipe()
+		e.pending = nil
+		e.setAuthState(AUTHSTATE_NONE)
+		e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "pending keychain expired"})
+		if e.current == nil {
+			e.setMsgState(MSGSTATE_PLAINTEXT) // it was our only session
+		}
+	}
+	if e.previous != nil && expired(e.previous.retired, e.expiry.previous) {
+		e.previous.wipe()
+		e.previous = nil
+		e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "previous keychain expired"})
+	}
+	if e.expiry.skippedKeys > 0 {
+		for _, kc := range []*keychain{e.previous, e.current} {
+			if kc != nil {
+				kc.expireSkipped(now, e.expiry.skippedKeys)
+			}
+		}
+	}
+}
+
+func testKeyExpiry() {
+	clock := &fakeClock{time.Unix(0, 0)}
+	a, b := initialize()
+	a.clock, b.clock = clock, clock
+	policy := expiryPolicy{skippedKeys: time.Hour, pending: 10 * time.Minute, previous: 24 * time.Hour}
+	a.expiry, b.expiry = policy, policy
+	testSyncDAKE(a, b)
+
+	rec := &recordTracer{}
+	b.tracer = rec
+	expectRejects := func(n int, why string) {
+		if got := countEvents(rec, EVENT_REJECT); got != n {
+			panic(fmt.Sprintf("%s: expected %d rejects, got %d", why, n, got))
+		}
+	}
+
+	// skipped keys of a ratchet Bob moved on from vanish after an hour
+	late1, late2 := mustSend(a.sendData()), mustSend(a.sendData())
+	b.receive(mustSend(a.sendData()))
+	lateRid := b.current.rid
+	a.receive(mustSend(b.sendData()))
+	b.receive(mustSend(a.sendData()))
+	clock.advance(30 * time.Minute)
+	b.receive(late1)
+	expectRejects(0, "a skipped key should be kept for a while")
+	clock.advance(30 * time.Minute)
+	b.receive(late2)
+	expectRejects(1, "a skipped key should expire")
+	if b.current.Ca[lateRid] != nil || b.current.Cb[lateRid] != nil || b.current.Ca[b.current.rid] == nil {
+		panic("only the chain keys of old ratchets should expire")
+	}
+	testSyncDataMessages(a, b)
+
+	// a DAKE Alice never answers is forgotten after 10 minutes
+	b.receive(a.query())
+	p1 := b.sendP1()
+	clock.advance(10 * time.Minute)
+	a.receive(mustSend(b.sendData()))
+	if b.pending != nil || b.AuthState != AUTHSTATE_NONE {
+		panic("the pending keychain should expire")
+	}
+	a.receive(p1)
+	b.receive(mustSend(a.sendP2()))
+	expectRejects(2, "a P2 after the pending keychain expired should be rejected")
+	if b.ssid != 1 {
+		panic("Bob should stay in his session")
+	}
+	clock.advance(10 * time.Minute)
+	b.receive(mustSend(a.sendData())) // Alice gives up on her pending keychain too
+	if a.pending != nil {
+		panic("the pending keychain of Alice should expire")
+	}
+	testSyncDataMessages(a, b)
+
+	// the previous session is forgotten after a day
+	late := mustSend(a.sendData())
+	testSyncDAKE(a, b)
+	testSyncDataMessages(a, b)
+	clock.advance(23 * time.Hour)
+	b.receive(mustSend(a.sendData()))
+	if b.previous == nil {
+		panic("the previous keychain should be kept for a while")
+	}
+	clock.advance(time.Hour)
+	b.receive(late)
+	expectRejects(3, "a message of an expired session should be rejected")
+	if b.previous != nil {
+		panic("the previous keychain should expire")
+	}
+	b.tracer = nil
+}
@@ -0,0 +1,121 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import "fmt"
+
+// ratchetLimits bound the work a data message makes us do before we know it
+// is authentic: the hashing to reach its chain key. Following its ratchet
+// costs one DH at most, as we drop a message which skips a ratchet.
+type ratchetLimits struct {
+	// message ids it may skip in its ratchet: defaultSkippedMessages when
+	// zero, and no limit when negative
+	skippedMessages int
+}
+
+// defaultSkippedMessages is the max_skip of OTRv4.
+const defaultSkippedMessages = 1000
+
+func (l ratchetLimits) maxSkipped() int {
+	if l.skippedMessages == 0 {
+		return defaultSkippedMessages
+	}
+	return l.skippedMessages
+}
+
+// testRatchetLimits has Mallory send Bob data messages which would make him
+// hash or DH a lot, or move his ratchet, before he can tell they are forged.
+func testRatchetLimits() {
+	a, b := initialize()
+	cb := newCountingProvider(b.provider())
+	b.crypto = cb
+	if b.limits.maxSkipped() != defaultSkippedMessages {
+		panic("should limit skipped messages by default")
+	}
+	b.limits = ratchetLimits{skippedMessages: 8}
+	testSyncDataMessages(testSyncDAKE(a, b))
+	rec := &recordTracer{}
+	b.tracer = rec
+	expectRejects := func(n int, why string) {
+		if got := countEvents(rec, EVENT_REJECT); got != n {
+			panic(fmt.Sprintf("%s: expected %d rejects, got %d", why, n, got))
+		}
+	}
+
+	m := mustSend(a.sendData())
+	forged := m
+	forged.mid = 1 << 30
+	kdfs := cb.counts["kdf"]
+	b.receive(forged)
+	expectRejects(1, "should reject a message far ahead in its ratchet")
+	if cb.counts["kdf"] != kdfs {
+		panic("should not hash towards a message past the limit")
+	}
+	b.receive(m)
+
+	// skipping up to the limit is fine
+	for i := 0; i < 8; i++ {
+		mustSend(a.sendData()) // lost
+	}
+	b.receive(mustSend(a.sendData()))
+	expectRejects(1, "should read a message within the limit")
+	for i := 0; i < 9; i++ {
+		mustSend(a.sendData()) // lost
+	}
+	b.receive(mustSend(a.sendData()))
+	expectRejects(2, "should reject a message past the limit")
+
+	// a forged new ratchet costs a DH, but does not move Bob's ratchet
+	a.receive(mustSend(b.sendData()))
+	m = mustSend(a.sendData())
+	forged = m
+	forged.dh = b.current.our_dh_pub
+	rid, dhs := b.currentRid(), cb.counts["dh"]
+	b.receive(forged)
+	if b.currentRid() != rid || cb.counts["dh"] != dhs+1 {
+		panic("should not follow a forged ratchet")
+	}
+	if len(b.outbox) != 0 || b.resyncing {
+		panic("should not answer nor resync for a forged message")
+	}
+	b.receive(m)
+	if b.currentRid() != rid+1 || countEvents(rec, EVENT_DECRYPT_OK) != 3 {
+		panic("should follow the ratchet of the authentic message")
+	}
+
+	// a message which skips a ratchet costs nothing
+	forged = mustSend(a.sendData())
+	forged.rid += 5
+	dhs = cb.counts["dh"]
+	b.receive(forged)
+	expectRejects(3, "should reject a message far ahead of our ratchet")
+	if cb.counts["dh"] != dhs || len(b.outbox) != 0 || b.resyncing {
+		panic("should not DH nor resync for a message which skips a ratchet")
+	}
+
+	forged = mustSend(a.sendData())
+	forged.mid = -1
+	b.receive(forged)
+	expectRejects(4, "should reject a negative message id")
+
+	// nor does any other message Bob can not tell from a forged one
+	for _, forge := range []func(m *Msg){
+		func(m *Msg) { m.ssid += 2 },
+		func(m *Msg) { m.rid += 2 },
+		func(m *Msg) { m.encKey = append(key{1}, m.encKey[1:]...) },
+		func(m *Msg) { m.ciphertext = append([]byte{}, m.ciphertext...); m.ciphertext[0] ^= 1 },
+	} {
+		forged = mustSend(a.sendData())
+		forge(&forged)
+		rid := b.currentRid()
+		b.receive(forged)
+		if b.currentRid() != rid || len(b.outbox) != 0 || b.resyncing || countEvents(rec, EVENT_DECRYPT_OK) != 3 {
+			panic("should drop a message which fails to authenticate")
+		}
+	}
+
+	b.receive(mustSend(a.sendData()))
+	testSyncDataMessages(a, b)
+	b.tracer = nil
+}
@@ -0,0 +1,306 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"crypto/dsa"
+	"fmt"
+	"math/big"
+)
+
+// dsaKey is our long term OTRv3 key, which also signs our profile during
+// the transition. We make one the first time a peer needs it.
+func (e *Entity) dsaKey() *dsa.PrivateKey {
+	if e.our_dsa_priv == nil {
+		var params dsa.Parameters
+		if err := dsa.GenerateParameters(&params, e.randReader(), dsa.L1024N160); err != nil {
+			panic("failed to generate DSA key.")
+		}
+		e.our_dsa_priv = &dsa.PrivateKey{PublicKey: dsa.PublicKey{Parameters: params}}
+		if err := dsa.GenerateKey(e.our_dsa_priv, e.randReader()); err != nil {
+			panic("failed to generate DSA key.")
+		}
+		e.our_profile = nil // so that it is signed with it too
+	}
+	return e.our_dsa_priv
+}
+
+// sendDHCommit starts the OTRv3 AKE in place of sending P1.
+func (e *Entity) sendDHCommit() Msg {
+	toSend := Msg{mtype: DHC, sender: e.name, version: '3', v3: e.legacyAKE.commit(e.randReader())}
+	e.traceMsg(EVENT_SEND, toSend)
+	e.setAuthState(AUTHSTATE_AWAITING_DRE_AUTH)
+	return toSend
+}
+
+func (e *Entity) receiveDHCommit(m Msg) {
+	if !e.policy.allows('3') {
+		e.reject(errNoCommonVersion)
+		return
+	}
+	ake := &v3AKE{}
+	if err := ake.receiveCommit(m.v3); err != nil {
+		e.reject(err)
+		return
+	}
+	e.version = '3'
+	e.legacyAKE = ake
+}
+
+// sendDHKey answers a DH-Commit in place of sending P2.
+func (e *Entity) sendDHKey() Msg {
+	toSend := Msg{mtype: DHK, sender: e.name, v3: e.legacyAKE.dhKey(e.randReader())}
+	e.traceMsg(EVENT_SEND, toSend)
+	e.setAuthState(AUTHSTATE_AWAITING_DRE_AUTH)
+	return toSend
+}
+
+// receiveDHKey has Bob reveal his key. The Reveal Signature goes out
+// through our outbox, as nothing asks us to send it.
+func (e *Entity) receiveDHKey(m Msg) {
+	if e.legacyAKE == nil || e.legacyAKE.state != V3_AWAITING_DHKEY {
+		e.reject(errNoDAKE)
+		return
+	}
+	reply, err := e.legacyAKE.receiveDHKey(e.randReader(), e.dsaKey(), m.v3)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	e.sendLegacyAKE(RS, reply)
+}
+
+func (e *Entity) receiveRevealSig(m Msg) {
+	if e.legacyAKE == nil || e.legacyAKE.state != V3_AWAITING_REVEALSIG {
+		e.reject(errNoDAKE)
+		return
+	}
+	reply, their, err := e.legacyAKE.receiveRevealSig(e.randReader(), e.dsaKey(), m.v3)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	e.sendLegacyAKE(SIG, reply)
+	e.startLegacySession(their)
+}
+
+func (e *Entity) receiveSig(m Msg) {
+	if e.legacyAKE == nil || e.legacyAKE.state != V3_AWAITING_SIG {
+		e.reject(errNoDAKE)
+		return
+	}
+	their, err := e.legacyAKE.receiveSig(m.v3)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	e.startLegacySession(their)
+}
+
+func (e *Entity) sendLegacyAKE(mtype int, v3 *v3Msg) {
+	toSend := Msg{mtype: mtype, sender: e.name, v3: v3}
+	e.traceMsg(EVENT_SEND, toSend)
+	e.outbox = append(e.outbox, toSend)
+}
+
+// startLegacySession replaces whatever session we had with the one of the
+// OTRv3 AKE which just completed.
+func (e *Entity) startLegacySession(their *dsa.PublicKey) {
+	ake := e.legacyAKE
+	keys := newV3Keys(e.randReader(), ake.our, ake.theirPub)
+	keys.ssid = ake.keys.ssid
+	e.legacyAKE = nil
+	e.wipeSession()
+
+	e.legacy = keys
+	e.their_dsa = their
+	e.setMsgState(MSGSTATE_ENCRYPTED)
+}
+
+// dropLegacy forgets the OTRv3 session, if any.
+func (e *Entity) dropLegacy() {
+	if e.legacyAKE != nil {
+		e.legacyAKE.our.wipe()
+		e.legacyAKE = nil
+	}
+	if e.legacy != nil {
+		e.legacy.wipe()
+		e.legacy = nil
+	}
+}
+
+func (e *Entity) sendLegacyData(plaintext []byte) Msg {
+	v3, revealed := e.legacy.seal(plaintext)
+	toSend := Msg{mtype: D, sender: e.name, ssid: e.ssid, v3: v3}
+	for _, mac := range revealed {
+		toSend.revealed = append(toSend.revealed, mac)
+	}
+	e.outgoing = nil
+	e.lastSent = e.now()
+
+	e.traceMsg(EVENT_SEND, toSend)
+	return toSend
+}
+
+func (e *Entity) receiveLegacyData(m Msg) {
+	if e.legacy == nil || m.v3 == nil {
+		e.reject(errUnknownSession)
+		return
+	}
+	plaintext, err := e.legacy.open(e.randReader(), m.v3)
+	if err != nil {
+		e.traceMsg(EVENT_DECRYPT_FAIL, m)
+		e.reject(err) // it may be forged
+		return
+	}
+	e.traceMsg(EVENT_DECRYPT_OK, m)
+
+	tlvs, err := decodeTLVs(plaintext)
+	if err != nil {
+		e.rejectWithError(err, ERROR_MALFORMED)
+		return
+	}
+	e.receiveTLVs(tlvs, m.ssid, nil, nil)
+	if e.msgState == MSGSTATE_FINISHED {
+		e.wipeSession()
+	}
+}
+
+// testLegacySession has Alice, who speaks both versions, talk to Bob, who
+// only speaks OTRv3, and then again once he upgraded.
+func testLegacySession() {
+	a, b := initialize()
+	a.policy.versions, b.policy.versions = "34", "3"
+	rec := &recordTracer{}
+	a.tracer, b.tracer = rec, rec
+	expectRejects := func(n int, why string) {
+		if got := countEvents(rec, EVENT_REJECT); got != n {
+			panic(fmt.Sprintf("%s: expected %d rejects, got %d", why, n, got))
+		}
+	}
+
+	b.receive(a.query())
+	a.receive(b.sendP1())           // DH-Commit
+	b.receive(mustSend(a.sendP2())) // DH-Key
+	if a.msgState != MSGSTATE_PLAINTEXT || b.msgState != MSGSTATE_PLAINTEXT {
+		panic("the AKE should not be done before the signatures")
+	}
+
+	// a Reveal Signature with a bad MAC is dropped
+	rs := b.takeOutbox()[0]
+	bad := rs
+	bad.v3 = &v3Msg{}
+	*bad.v3 = *rs.v3
+	bad.v3.macSig = append([]byte{}, rs.v3.macSig...)
+	bad.v3.macSig[0] ^= 1
+	a.receive(bad)
+	expectRejects(1, "should reject a Reveal Signature with a bad MAC")
+	if a.msgState != MSGSTATE_PLAINTEXT {
+		panic("should not start a session from a bad Reveal Signature")
+	}
+
+	a.receive(rs)
+	deliverOutbox(a, b) // Signature
+	if a.legacy == nil || b.legacy == nil || a.msgState != MSGSTATE_ENCRYPTED || b.msgState != MSGSTATE_ENCRYPTED {
+		panic("should be in an OTRv3 session")
+	}
+	if a.their_dsa.Y.Cmp(b.our_dsa_priv.Y) != 0 || b.their_dsa.Y.Cmp(a.our_dsa_priv.Y) != 0 {
+		panic("should know the DSA key of each other")
+	}
+
+	// data goes both ways, and the keys move on with it
+	var revealed int
+	exchange := func(from, to *Entity) {
+		m := mustSend(from.sendData())
+		revealed += len(m.revealed)
+		to.receive(m)
+	}
+	for i := 0; i < 3; i++ {
+		exchange(a, b)
+		exchange(a, b)
+		exchange(b, a)
+	}
+	expectRejects(1, "should read OTRv3 data messages")
+	if a.legacy.ourKeyID < 4 || b.legacy.theirKeyID < 4 || revealed == 0 {
+		panic("should rotate the DH keys and reveal old MAC keys")
+	}
+
+	// OTRv3 counters only go up: late and replayed messages are dropped
+	m1, m2 := mustSend(a.sendData()), mustSend(a.sendData())
+	b.receive(m2)
+	b.receive(m1)
+	b.receive(m2)
+	expectRejects(3, "should reject late and replayed messages")
+	tampered := mustSend(a.sendData())
+	tampered.v3.encrypted = append(tampered.v3.encrypted, 0)
+	b.receive(tampered)
+	expectRejects(4, "should reject a message with a bad MAC")
+
+	var got []string
+	b.registerTLV(TLV_CUSTOM, func(t tlv) error {
+		got = append(got, string(t.value))
+		return nil
+	})
+	must(a.sendTLV(tlv{TLV_CUSTOM, []byte("hello")}))
+	exchange(a, b)
+	if fmt.Sprint(got) != "[hello]" {
+		panic("should carry TLVs in OTRv3 data messages")
+	}
+
+	// nor do we send or accept extra keys of OTRv4
+	if _, _, err := a.sendExtraKey(1, nil); err != errNoExtraKey {
+		panic("should not send extra keys in OTRv3")
+	}
+	a.outgoing = append(a.outgoing, extraKeyTLV(1, nil))
+	exchange(a, b)
+	expectRejects(5, "should reject extra keys in OTRv3")
+
+	// a signature by a DSA key whose Q is larger than the hash
+	large := &dsa.PrivateKey{PublicKey: dsa.PublicKey{
+		Parameters: dsa.Parameters{P: randomBits(a, 2048), Q: randomBits(a, 320), G: big.NewInt(2)},
+		Y:          big.NewInt(2),
+	}, X: big.NewInt(3)}
+	ake := &v3AKE{our: generateDH1536(a.randReader()), theirPub: generateDH1536(a.randReader()).pub}
+	ck, mk1, mk2 := make([]byte, 16), make([]byte, 32), make([]byte, 32)
+	enc, mac := ake.sign(a.randReader(), large, ck, mk1, mk2)
+	if _, err := ake.verify(enc, mac, ck, mk1, mk2); err != errV3Malformed {
+		panic("should not accept a DSA key whose Q is larger than 256 bits")
+	}
+
+	// SMP binds the DSA keys and the session id of the AKE
+	must(a.startSMP("", []byte("blue")))
+	exchange(a, b)
+	must(b.answerSMP([]byte("blue")))
+	exchange(b, a)
+	exchange(a, b)
+	exchange(b, a)
+	if a.smp.result != SMP_SUCCEEDED || b.smp.result != SMP_SUCCEEDED {
+		panic("should run SMP in OTRv3 sessions")
+	}
+
+	// Bob upgrades: the next DAKE is an OTRv4 one, and replaces the session
+	b.policy.versions = "34"
+	testSyncDAKE(a, b)
+	if a.version != '4' || b.version != '4' || a.legacy != nil || b.legacy != nil {
+		panic("should move on to OTRv4")
+	}
+	testSyncDataMessages(a, b)
+	expectRejects(5, "should read OTRv4 data messages")
+
+	// and back to OTRv3, which Alice ends
+	b.policy.versions = "3"
+	b.receive(a.query())
+	a.receive(b.sendP1())
+	b.receive(mustSend(a.sendP2()))
+	deliverOutbox(b, a)
+	if a.current != nil || b.current != nil || a.legacy == nil {
+		panic("an OTRv3 session should replace the OTRv4 one")
+	}
+	exchange(b, a)
+	b.receive(mustSend(a.endSession()))
+	if a.legacy != nil || b.legacy != nil || b.msgState != MSGSTATE_FINISHED {
+		panic("should end OTRv3 sessions too")
+	}
+	a.tracer, b.tracer = nil, nil
+}
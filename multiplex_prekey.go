@@ -0,0 +1,268 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import "time"
+
+// publishPrekey makes a prekey message from which a peer can start a new
+// DAKE while we are offline.
+func (e *Entity) publishPrekey() prekeyMsg {
+	profile := e.profile()
+	if e.shared_prekey_pub == (pubkey{}) {
+		e.shared_prekey_priv, e.shared_prekey_pub = e.generateKeys()
+	}
+	if e.prekeys == nil {
+		e.prekeys = make(map[uint32]*keychain)
+	}
+
+	e.lastPrekeyID++
+	kc := e.newKeychain()
+	kc.our_dh_priv, kc.our_dh_pub = e.generateKeys()
+	e.prekeys[e.lastPrekeyID] = kc
+
+	pm := prekeyMsg{
+		id:              e.lastPrekeyID,
+		instanceTag:     e.ourInstanceTag(),
+		profile:         profile,
+		y:               kc.our_dh_pub,
+		sharedPrekey:    e.shared_prekey_pub,
+		sharedPrekeySig: signSharedPrekey(e.provider(), e.our_identity_priv, e.shared_prekey_pub),
+	}
+	pm.sig = e.provider().sign(e.our_identity_priv, pm.body())
+	return pm
+}
+
+func (e *Entity) publishPrekeys(s prekeyService, n int) error {
+	pms := make([]prekeyMsg, n)
+	for i := range pms {
+		pms[i] = e.publishPrekey()
+	}
+	return s.publish(pms)
+}
+
+// sendNI answers a prekey message. It is like sending a P2 without having
+// sent a query nor received a P1: the new keychain is ready right away.
+func (e *Entity) sendNI(pm prekeyMsg) (Msg, error) {
+	if err := pm.validate(e.provider(), e.now()); err != nil {
+		return Msg{}, err
+	}
+	profile := e.profile()
+	priv, pub := e.generateKeys()
+	ephemeral, err := e.computeSecret(priv, pm.y)
+	if err != nil {
+		return Msg{}, err
+	}
+	shared, err := e.computeSecret(priv, pm.sharedPrekey)
+	if err != nil {
+		return Msg{}, err
+	}
+	secret := nonInteractiveSecret(ephemeral, shared, e.our_identity_pub, pm.profile.identity)
+	kc := e.newKeychain()
+	if e.usesBrace() {
+		// nothing to encapsulate to, but Bob gets our keys
+		if err := e.refreshBrace(kc); err != nil {
+			return Msg{}, err
+		}
+	}
+	e.their_profile = pm.profile
+
+	e.pending = kc
+	e.pending.their_dh = pm.y
+	e.pending.our_dh_priv, e.pending.our_dh_pub = priv, pub
+	e.pending.derive(secret[:])
+	e.pending.j = 0 // she will ratchet when sending next
+
+	toSend := Msg{mtype: NI, sender: e.name, rid: -1, mid: -1, dh: e.pending.our_dh_pub, ssid: e.ssid + 1, prekeyID: pm.id, profile: profile,
+		kemEk: e.pending.sent_kem_ek, kemCt: e.pending.sent_kem_ct, dh3072: e.pending.sent_dh3072}
+	toSend.sig = e.provider().sign(e.our_identity_priv, niBody(toSend.dakeBody(), pm.y, pm.sharedPrekey, pm.profile.identity))
+	e.traceMsg(EVENT_SEND, toSend)
+	e.version = '4'
+	e.dropLegacy()
+	e.setMsgState(MSGSTATE_ENCRYPTED)
+	return toSend, nil
+}
+
+// receiveNI uses up the prekey a NI message answers, once its signature
+// tells us who sent it.
+func (e *Entity) receiveNI(m Msg) {
+	kc, ok := e.prekeys[m.prekeyID]
+	if !ok {
+		e.reject(errUnknownPrekey)
+		return
+	}
+	if !e.provider().verify(m.sig, niBody(m.dakeBody(), kc.our_dh_pub, e.shared_prekey_pub, e.our_identity_pub), m.profile.identity) {
+		e.reject(errDAKESignature)
+		return
+	}
+	ephemeral, err := e.computeSecret(kc.our_dh_priv, m.dh)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	shared, err := e.computeSecret(e.shared_prekey_priv, m.dh)
+	if err != nil {
+		e.reject(err)
+		return
+	}
+	secret := nonInteractiveSecret(ephemeral, shared, m.profile.identity, e.our_identity_pub)
+	if e.usesBrace() {
+		if err := kc.followBrace(m); err != nil {
+			e.reject(err)
+			return
+		}
+	}
+	delete(e.prekeys, m.prekeyID)
+
+	e.their_profile = m.profile
+	e.pending = kc
+	e.pending.their_dh = m.dh
+	e.pending.derive(secret[:])
+	e.pending.j = 1 // so he does not ratchet
+
+	e.adoptSSID(m.ssid)
+	e.switchKeychain()
+	e.setAuthState(AUTHSTATE_NONE)
+	e.version = '4'
+	e.dropLegacy()
+	e.setMsgState(MSGSTATE_ENCRYPTED)
+	e.retryUnread()
+}
+
+// NOTE Bob is offline from publishing the prekey message until he receives
+// NOTE everything Alice sent.
+func testNonInteractiveDAKE(a, b *Entity) (*Entity, *Entity) {
+	pm := b.publishPrekey() // Bob publishes a prekey message and goes offline
+
+	ni, err := a.sendNI(pm) // Alice starts a new DAKE from it
+	if err != nil {
+		panic(err)
+	}
+	d0 := mustSend(a.sendData()) // ... and sends data right away
+	d1 := mustSend(a.sendData())
+
+	b.receive(ni) // Bob comes back. The DAKE finishes for him.
+	b.receive(d0)
+	b.receive(d1)
+
+	return a, b
+}
+
+// NOTE server is nil when it is out of process, so we can not be notified.
+// NOTE Bob has two instances, and Mallory tries to publish for him.
+func testPrekeyServer(s prekeyService, server *prekeyServer) {
+	a, b := initialize()
+	b.profile()
+	b2 := new(Entity) // Bob on another device
+	b2.name = b.name
+	b2.our_identity_priv, b2.our_identity_pub = b.our_identity_priv, b.our_identity_pub
+	low := 0
+	if server != nil {
+		server.notifyLow = func(identity string, instanceTag uint32, left int) {
+			if identity != b.name || (instanceTag != b.instanceTag && instanceTag != b2.instanceTag) || left != 0 {
+				panic("wrong low prekeys notification")
+			}
+			low++
+		}
+	}
+
+	if server != nil {
+		server.clock = &fakeClock{time.Now().Add(profileLifetime)}
+		if err := b.publishPrekeys(s, 1); err == nil {
+			panic("should not store prekey messages which expired on the server clock")
+		}
+		server.clock = nil
+	}
+	for _, e := range []*Entity{b, b2} {
+		if err := e.publishPrekeys(s, 2); err != nil {
+			panic(err)
+		}
+	}
+
+	m := new(Entity)
+	m.name = b.name
+	if err := m.publishPrekeys(s, 1); err == nil {
+		panic("should not store prekey messages for a name of another identity key")
+	}
+	forged := b.publishPrekey()
+	forged.y = m.publishPrekey().y
+	if err := s.publish([]prekeyMsg{forged}); err == nil {
+		panic("should not store prekey messages which Bob did not sign")
+	}
+
+	pms1, err := s.fetch(b.name)
+	if err != nil {
+		panic(err)
+	}
+	pms2, err := s.fetch(b.name)
+	if err != nil {
+		panic(err)
+	}
+	if len(pms1) != 2 || len(pms2) != 2 || pms1[0].instanceTag == pms1[1].instanceTag {
+		panic("should get a prekey message for each instance")
+	}
+	for i := range pms1 {
+		if pms1[i].instanceTag == pms2[i].instanceTag && pms1[i].id == pms2[i].id {
+			panic("a prekey message was handed out twice")
+		}
+	}
+	if _, err := s.fetch(b.name); err != errNoPrekeys {
+		panic("prekey messages should have run out")
+	}
+	if server != nil && low != 2 {
+		panic("should have been notified of low prekeys once per instance")
+	}
+
+	for _, pm := range pms2 {
+		if pm.instanceTag != b.instanceTag {
+			continue
+		}
+		ni, err := a.sendNI(pm)
+		if err != nil {
+			panic(err)
+		}
+		b.receive(ni)
+	}
+	testSyncDataMessages(a, b)
+}
+
+// NOTE Mallory replays a NI message, forges one from Alice's profile, and
+// NOTE answers a prekey message whose signature is bad. Bob and Mallory
+// NOTE must not get a session out of it.
+func testNonInteractiveRejects() {
+	a, b := initialize()
+	m := new(Entity)
+	m.name = "Mallory"
+	m.profile()
+	rec := &recordTracer{}
+	b.tracer = multiTracer{defaultTracer, rec}
+
+	pm := b.publishPrekey()
+	ni, err := a.sendNI(pm)
+	if err != nil {
+		panic(err)
+	}
+
+	// Mallory swaps in her own DH key, but can only sign as herself
+	forged := ni
+	_, forged.dh = m.generateKeys()
+	b.receive(forged)
+	forged.sig = m.provider().sign(m.our_identity_priv, forged.dakeBody())
+	b.receive(forged)
+	if countEvents(rec, EVENT_REJECT) != 2 || b.current != nil || len(b.prekeys) != 1 {
+		panic("a forged NI should be rejected, and leave the prekey alone")
+	}
+
+	b.receive(ni)
+	b.receive(ni)
+	if countEvents(rec, EVENT_REJECT) != 3 {
+		panic("a replayed NI should be rejected")
+	}
+	testSyncDataMessages(a, b)
+
+	bad := b.publishPrekey()
+	bad.sharedPrekeySig[0] ^= 1
+	if _, err := m.sendNI(bad); err == nil || m.pending != nil {
+		panic("should not answer a prekey message with a bad signature")
+	}
+}
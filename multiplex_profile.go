@@ -0,0 +1,189 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"crypto/dsa"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// profile is our signed client profile. A new one is signed when the last
+// one has expired.
+func (e *Entity) profile() *clientProfile {
+	if e.our_identity_pub == (pubkey{}) {
+		e.our_identity_priv, e.our_identity_pub = e.provider().generateSigningKeys()
+	}
+	if e.our_profile == nil || !e.now().Before(e.our_profile.expiration) {
+		e.our_profile = newClientProfile(e.provider(), e.randReader(), e.name, e.ourInstanceTag(), e.our_identity_priv, e.our_identity_pub, e.now().Add(profileLifetime), e.our_dsa_priv)
+	}
+	return e.our_profile
+}
+
+func (e *Entity) ourInstanceTag() uint32 {
+	if e.instanceTag == 0 {
+		e.instanceTag = newInstanceTag(e.randReader())
+	}
+	return e.instanceTag
+}
+
+// NOTE Alice receives P1s with bad profiles before the good one. She must
+// NOTE drop them as if they never arrived.
+func testClientProfiles() {
+	a, b := initialize()
+	b.receive(a.query())
+	p1 := b.sendP1()
+
+	sign := func(instanceTag uint32, expiration time.Time) *clientProfile {
+		return newClientProfile(b.provider(), b.randReader(), b.name, instanceTag, b.our_identity_priv, b.our_identity_pub, expiration, nil)
+	}
+	tampered := *p1.profile
+	tampered.expiration = tampered.expiration.Add(profileLifetime)
+
+	for _, c := range []struct {
+		profile *clientProfile
+		err     error
+	}{
+		{nil, errProfileMalformed},
+		{sign(b.ourInstanceTag(), time.Now().Add(-time.Hour)), errProfileExpired},
+		{sign(0x42, time.Now().Add(profileLifetime)), errProfileMalformed},
+		{&tampered, errProfileSignature},
+	} {
+		if err := c.profile.validate(a.provider(), time.Now()); err != c.err {
+			panic(fmt.Sprintf("expected %v, got %v", c.err, err))
+		}
+
+		bad := p1
+		bad.profile = c.profile
+		a.receive(bad)
+		if a.pending != nil || a.their_profile != nil {
+			panic("a P1 with a bad profile should be dropped")
+		}
+	}
+
+	a.receive(p1)
+	b.receive(mustSend(a.sendP2()))
+	if a.their_profile != p1.profile || b.their_profile != a.profile() {
+		panic("should know the profile of each other")
+	}
+	testSyncDataMessages(a, b)
+
+	// Alice signs a new profile when hers expires
+	old := a.profile()
+	old.expiration = time.Now()
+	if a.profile() == old || a.profile().validate(a.provider(), time.Now()) != nil {
+		panic("should sign a new profile when it expires")
+	}
+}
+
+// NOTE Mallory sends Bob's profile with her own keys, and Alice answers a
+// NOTE P1 of Bob from an earlier DAKE. Nobody gets a session out of them.
+func testProfileBinding() {
+	a, b := initialize()
+	m := new(Entity)
+	m.name = "Mallory"
+	recA, recB := &recordTracer{}, &recordTracer{}
+	a.tracer, b.tracer = multiTracer{defaultTracer, recA}, multiTracer{defaultTracer, recB}
+
+	b.receive(a.query())
+	p1 := b.sendP1()
+	m.receive(a.query())
+	replayed := m.sendP1()
+	replayed.profile = p1.profile
+	a.receive(replayed)
+	replayed.sender = b.name
+	a.receive(replayed)
+	if countEvents(recA, EVENT_REJECT) != 2 || a.pending != nil || a.their_profile != nil {
+		panic("a P1 with a replayed profile should be dropped")
+	}
+
+	a.receive(p1)
+	p2 := mustSend(a.sendP2())
+	forged := p2
+	_, forged.dh = m.generateKeys()
+	b.receive(forged)
+	if countEvents(recB, EVENT_REJECT) != 1 || b.current != nil {
+		panic("a P2 with a replayed profile should be dropped")
+	}
+
+	b.receive(a.query()) // a new DAKE, but Alice answers the old P1 again
+	a.receive(p1)
+	b.receive(mustSend(a.sendP2()))
+	if countEvents(recB, EVENT_REJECT) != 2 || b.current != nil {
+		panic("a P2 answering an old P1 should be dropped")
+	}
+
+	b.receive(a.query())
+	a.receive(b.sendP1())
+	b.receive(mustSend(a.sendP2()))
+	testSyncDataMessages(a, b)
+}
+
+func testTransitionalClientProfile() {
+	a, b := initialize()
+
+	var params dsa.Parameters
+	if err := dsa.GenerateParameters(&params, b.randReader(), dsa.L1024N160); err != nil {
+		panic(err)
+	}
+	b.our_dsa_priv = &dsa.PrivateKey{PublicKey: dsa.PublicKey{Parameters: params}}
+	if err := dsa.GenerateKey(b.our_dsa_priv, b.randReader()); err != nil {
+		panic(err)
+	}
+
+	testSyncDataMessages(testSyncDAKE(a, b))
+	if a.their_profile.dsaKey == nil {
+		panic("should have received a transitional profile")
+	}
+
+	// a forged transitional signature, with a good identity signature over it
+	forged := *b.profile()
+	forged.transitionalSig = append([]byte{}, forged.transitionalSig...)
+	forged.transitionalSig[0] ^= 1
+	forged.sig = b.provider().sign(b.our_identity_priv, forged.body())
+	if err := forged.validate(a.provider(), time.Now()); err != errProfileSignature {
+		panic("should not accept a bad transitional signature")
+	}
+
+	// a DSA key without its parameters
+	partial := *b.profile()
+	partial.dsaKey = &dsa.PublicKey{Y: partial.dsaKey.Y}
+	if err := partial.validate(a.provider(), time.Now()); err != errProfileMalformed {
+		panic("should not accept a DSA key without its parameters")
+	}
+
+	// a 2048/320 DSA key: its Q is larger than the hash we sign
+	large := *b.profile()
+	large.dsaKey = &dsa.PublicKey{
+		Parameters: dsa.Parameters{P: randomBits(b, 2048), Q: randomBits(b, 320), G: big.NewInt(2)},
+		Y:          big.NewInt(2),
+	}
+	large.transitionalSig = make([]byte, 2*320/8)
+	large.sig = b.provider().sign(b.our_identity_priv, large.body())
+	if err := large.validate(a.provider(), time.Now()); err != errProfileMalformed {
+		panic("should not accept a DSA key whose Q is larger than 256 bits")
+	}
+	rec := &recordTracer{}
+	a.tracer = rec
+	b.receive(a.query())
+	p1 := b.sendP1()
+	p1.profile = &large
+	a.receive(p1)
+	if countEvents(rec, EVENT_REJECT) != 1 || a.pending != nil {
+		panic("should reject a P1 with a DSA key whose Q is larger than 256 bits")
+	}
+	a.tracer = nil
+}
+
+// randomBits is a random number of exactly n bits.
+func randomBits(e *Entity, n int) *big.Int {
+	b := make([]byte, n/8)
+	if _, err := io.ReadFull(e.randReader(), b); err != nil {
+		panic(err)
+	}
+	b[0] |= 0x80
+	return new(big.Int).SetBytes(b)
+}
@@ -0,0 +1,225 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxUnread bounds the messages we buffer, and those we keep for the peer
+// to ask again.
+const maxUnread = 16
+
+// waitsForDAKE tells whether m belongs to the session of a DAKE we are in,
+// which we can read once the P2 gets here.
+func (e *Entity) waitsForDAKE(m Msg) bool {
+	return m.v3 == nil && m.ssid == e.ssid+1 && e.pending != nil && !e.pending.ready()
+}
+
+func (e *Entity) bufferUnread(m Msg) {
+	if len(e.unread) == maxUnread {
+		e.unread = e.unread[1:]
+	}
+	e.unread = append(e.unread, m)
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: fmt.Sprintf("buffered %d unread", len(e.unread))})
+}
+
+// keepUnread keeps m, which we can not read: either we and the peer are out
+// of sync, or m is forged. We can not tell which, so the peer does not hear
+// from us until resyncIfStuck.
+func (e *Entity) keepUnread(m Msg) {
+	if e.replaying {
+		return
+	}
+	e.bufferUnread(m)
+	if e.unreadSince.IsZero() {
+		e.unreadSince = e.now()
+	}
+}
+
+// resyncIfStuck starts a new DAKE to get back in sync when we could not read
+// the peer for resyncAfter, and tells the peer why.
+func (e *Entity) resyncIfStuck() {
+	if e.resyncAfter == 0 || e.unreadSince.IsZero() || e.resyncing || e.now().Sub(e.unreadSince) < e.resyncAfter {
+		return
+	}
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: fmt.Sprintf("desync: read nothing of the peer for %v", e.resyncAfter)})
+	e.resyncing = true
+	e.sendError(ERROR_UNREADABLE)
+	e.outbox = append(e.outbox, e.query())
+}
+
+// retryUnread gives the messages we buffered another go, now that a DAKE is
+// done. Those we still can not read are dropped, and if the policy says so
+// we ask the peer to send them again.
+func (e *Entity) retryUnread() {
+	unread := e.unread
+	e.unread, e.resyncing, e.unreadSince = nil, false, time.Time{}
+	if len(unread) == 0 {
+		return
+	}
+	lost := 0
+	e.replaying = true
+	for _, m := range unread {
+		if !e.readData(m) {
+			lost++
+		}
+	}
+	e.replaying = false
+	if lost == 0 {
+		return
+	}
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: fmt.Sprintf("dropped %d unread", lost)})
+	if e.policy.retransmit {
+		e.outgoing = append(e.outgoing, retransmitTLV(lost))
+	}
+}
+
+// adoptSSID numbers the session the peer started as the peer does. Our
+// numbers drift apart when a DAKE replaces one the peer never switched to.
+func (e *Entity) adoptSSID(ssid int) {
+	if ssid != e.ssid+1 {
+		e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: fmt.Sprintf("ssid resynced to %d", ssid)})
+		e.ssid = ssid - 1
+	}
+}
+
+// A sentPayload is what we sent in a data message of kc that the peer may
+// ask for again: the TLVs of the application.
+type sentPayload struct {
+	kc   *keychain
+	tlvs []tlv
+}
+
+func (e *Entity) recordSent(kc *keychain, tlvs []tlv) {
+	var app []tlv
+	for _, t := range tlvs {
+		if t.typ >= TLV_CUSTOM {
+			app = append(app, t)
+		}
+	}
+	if len(e.sent) == maxUnread {
+		e.sent = e.sent[1:]
+	}
+	e.sent = append(e.sent, sentPayload{kc, app})
+}
+
+// retransmit sends again what we sent in the last n data messages before
+// kc, the keychain the peer asked in.
+func (e *Entity) retransmit(n int, kc *keychain) {
+	var before []sentPayload
+	for _, p := range e.sent {
+		if p.kc != kc {
+			before = append(before, p)
+		}
+	}
+	if n < len(before) {
+		before = before[len(before)-n:]
+	}
+	for _, p := range before {
+		if len(p.tlvs) == 0 {
+			continue
+		}
+		e.outgoing = append(e.outgoing, p.tlvs...)
+		e.queueData()
+	}
+}
+
+// testResync loses and reorders messages around DAKEs, and has Bob get back
+// in sync with Alice when he can not follow her anymore.
+func testResync() {
+	rec := &recordTracer{}
+	expectFails := func(n int, why string) {
+		if got := countEvents(rec, EVENT_DECRYPT_FAIL) + countEvents(rec, EVENT_REJECT); got != n {
+			panic(fmt.Sprintf("%s: expected %d failures, got %d", why, n, got))
+		}
+	}
+
+	// Bob loses the first message of Alice's new ratchet, then they DAKE
+	a, b := runFreshDAKE()
+	a.tracer, b.tracer = rec, rec
+	a.receive(mustSend(b.sendData()))
+	mustSend(a.sendData()) // lost
+	b.receive(mustSend(a.sendData()))
+	a.receive(mustSend(b.sendData()))
+	mustSend(b.sendData()) // lost, the first of Bob's new ratchet
+	testSyncDAKE(a, b)
+	testSyncDataMessages(a, b)
+	testSyncDataMessages(b, a)
+	expectFails(0, "lost messages")
+
+	// Bob gets Alice's data before the P2 that sends him in her session
+	b.receive(a.query())
+	a.receive(b.sendP1())
+	p2 := mustSend(a.sendP2())
+	b.receive(mustSend(a.sendData()))
+	b.receive(mustSend(a.sendData()))
+	b.receive(p2)
+	if countEvents(rec, EVENT_DECRYPT_OK) == 0 || len(b.unread) != 0 {
+		panic("should read data sent before the P2 once it gets here")
+	}
+	testSyncDataMessages(b, a)
+	expectFails(0, "data before the P2")
+
+	// a DAKE of Alice replaces one Bob did not switch to yet: he has
+	// other keys for her messages. They could be forged for all he knows, so
+	// he starts a new DAKE only once he read nothing of her for a minute.
+	clock := &fakeClock{time.Unix(0, 0)}
+	b.clock = clock
+	b.resyncAfter = time.Minute
+	testSyncDAKE(b, a)
+	testSyncDAKE(a, b)
+	var got []string
+	b.registerTLV(TLV_CUSTOM, func(t tlv) error {
+		got = append(got, string(t.value))
+		return nil
+	})
+	b.policy.retransmit = true
+	must(a.sendTLV(tlv{TLV_CUSTOM, []byte("hello")}))
+	b.receive(mustSend(a.sendData()))
+	if len(b.unread) != 1 || b.resyncing || len(b.outbox) != 0 {
+		panic("should keep the message, and wait")
+	}
+	clock.advance(time.Minute)
+	b.receive(mustSend(a.sendData()))
+	if len(b.unread) != 2 || !b.resyncing {
+		panic("should start a new DAKE after a minute")
+	}
+
+	deliverOutbox(b, a) // the error message and the query
+	b.receive(a.sendP1())
+	a.receive(mustSend(b.sendP2()))
+	if a.ssid != b.ssid || len(b.unread) != 0 || b.resyncing {
+		panic("should be in the same session again")
+	}
+	a.receive(mustSend(b.sendData())) // asks Alice to send hello again
+	deliverOutbox(a, b)
+	if fmt.Sprint(got) != "[hello]" {
+		panic("should get the lost message again, got " + fmt.Sprint(got))
+	}
+	testSyncDataMessages(a, b)
+	testSyncDataMessages(b, a)
+	expectFails(4, "resync") // the two desyncs, and the drops after the DAKE
+
+	// without the policy, the message is only dropped
+	b.policy.retransmit = false
+	testSyncDAKE(b, a)
+	testSyncDAKE(a, b)
+	must(a.sendTLV(tlv{TLV_CUSTOM, []byte("again")}))
+	b.receive(mustSend(a.sendData()))
+	clock.advance(time.Minute)
+	b.receive(mustSend(a.sendData()))
+	deliverOutbox(b, a)
+	b.receive(a.sendP1())
+	a.receive(mustSend(b.sendP2()))
+	a.receive(mustSend(b.sendData()))
+	if len(a.outbox) != 0 || fmt.Sprint(got) != "[hello]" {
+		panic("should not ask for the message again")
+	}
+	testSyncDataMessages(a, b)
+	expectFails(8, "resync without retransmit")
+	a.tracer, b.tracer = nil, nil
+	b.clock, b.resyncAfter = nil, 0
+}
@@ -0,0 +1,163 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+)
+
+var errNoSMPQuestion = errors.New("no SMP question to answer")
+
+// smpSecret is x of an SMP run in our session. The initiator is whoever
+// asked the question.
+func (e *Entity) smpSecret(initiator bool, secret []byte) (*big.Int, error) {
+	var ours, theirs, sessionID []byte
+	switch {
+	case e.legacy != nil:
+		ours, theirs, sessionID = dsaFingerprint(&e.dsaKey().PublicKey), dsaFingerprint(e.their_dsa), e.legacy.ssid
+	case e.current != nil && e.their_profile != nil:
+		ours, theirs, sessionID = e.our_identity_pub[:], e.their_profile.identity[:], e.current.sessionID()
+	default:
+		return nil, errNoSession
+	}
+	if initiator {
+		return smpSecret(ours, theirs, sessionID, secret), nil
+	}
+	return smpSecret(theirs, ours, sessionID, secret), nil
+}
+
+// startSMP asks the peer whether they know secret, showing them question
+// if it is not empty. SMP messages go out in our next data messages.
+func (e *Entity) startSMP(question string, secret []byte) error {
+	if err := e.readyToSend(); err != nil {
+		return err
+	}
+	x, err := e.smpSecret(true, secret)
+	if err != nil {
+		return err
+	}
+	prev := e.smp
+	t := e.smp.start(e.randReader(), x, question, e.ssid)
+	if !t.fits() {
+		e.smp = prev
+		return errTLVTooLong
+	}
+	e.outgoing = append(e.outgoing, t)
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "SMP started"})
+	return nil
+}
+
+// answerSMP is the secret the user typed after the peer started SMP. The
+// run aborts if the session changed in between.
+func (e *Entity) answerSMP(secret []byte) error {
+	if e.smp.state != SMPSTATE_EXPECT_SECRET {
+		return errNoSMPQuestion
+	}
+	if e.smp.ssid != e.ssid {
+		e.abortSMP()
+		return errSMPState
+	}
+	x, err := e.smpSecret(false, secret)
+	if err != nil {
+		return err
+	}
+	e.outgoing = append(e.outgoing, e.smp.answer(e.randReader(), x))
+	return nil
+}
+
+func (e *Entity) abortSMP() {
+	e.smp.abort()
+	e.outgoing = append(e.outgoing, tlv{TLV_SMP_ABORT, nil})
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "SMP " + smpResultNames[SMP_ABORTED]})
+}
+
+func (e *Entity) receiveSMP(t tlv, ssid int) {
+	reply, err := e.smp.receive(e.randReader(), t, ssid)
+	if err != nil {
+		e.reject(err)
+	}
+	if reply != nil {
+		e.outgoing = append(e.outgoing, *reply)
+	}
+
+	switch {
+	case e.smp.state == SMPSTATE_EXPECT_SECRET && e.smp.question != "":
+		e.trace(event{kind: EVENT_NOTE, ssid: ssid, note: "SMP asked: " + e.smp.question})
+	case e.smp.state == SMPSTATE_EXPECT_SECRET:
+		e.trace(event{kind: EVENT_NOTE, ssid: ssid, note: "SMP asked"})
+	case e.smp.state == SMPSTATE_EXPECT1 && e.smp.result != SMP_NONE:
+		e.trace(event{kind: EVENT_NOTE, ssid: ssid, note: "SMP " + smpResultNames[e.smp.result]})
+	}
+}
+
+func testSMP(a, b *Entity) {
+	expectResult := func(want smpResult) {
+		if a.smp.result != want || b.smp.result != want {
+			panic("SMP should have " + smpResultNames[want] + ", got " + smpResultNames[a.smp.result] + " and " + smpResultNames[b.smp.result])
+		}
+	}
+	// run answers a question of Alice and exchanges the rest of the run
+	run := func(answer string) {
+		b.receive(mustSend(a.sendData()))
+		if b.smp.state != SMPSTATE_EXPECT_SECRET || b.smp.question != "favourite color?" {
+			panic("Bob should be asked the question")
+		}
+		must(b.answerSMP([]byte(answer)))
+		a.receive(mustSend(b.sendData())) // SMP2
+		b.receive(mustSend(a.sendData())) // SMP3
+		a.receive(mustSend(b.sendData())) // SMP4
+	}
+
+	// nothing to run SMP in before a session, nor to answer before a question
+	c, _ := initialize()
+	if c.startSMP("", []byte("blue")) != errNoSession || c.answerSMP([]byte("blue")) != errNoSMPQuestion || len(c.outgoing) != 0 {
+		panic("should need a session and a question for SMP")
+	}
+
+	must(a.startSMP("favourite color?", []byte("blue")))
+	run("blue")
+	expectResult(SMP_SUCCEEDED)
+
+	must(a.startSMP("favourite color?", []byte("blue")))
+	run("red")
+	expectResult(SMP_FAILED)
+
+	// Bob gives up after the question
+	must(a.startSMP("favourite color?", []byte("blue")))
+	b.receive(mustSend(a.sendData()))
+	b.abortSMP()
+	a.receive(mustSend(b.sendData()))
+	expectResult(SMP_ABORTED)
+
+	// a message out of order aborts both
+	must(b.startSMP("", []byte("blue")))
+	m := mustSend(b.sendData())
+	must(b.startSMP("", []byte("blue")))
+	a.receive(m)
+	must(a.answerSMP([]byte("blue")))
+	b.receive(mustSend(a.sendData())) // the SMP2 belongs to the first run
+	a.receive(mustSend(b.sendData()))
+	expectResult(SMP_ABORTED)
+
+	// a new DAKE between the question and the answer aborts the run
+	must(a.startSMP("favourite color?", []byte("blue")))
+	b.receive(mustSend(a.sendData()))
+	testSyncDAKE(a, b)
+	testSyncDataMessages(a, b)
+	if b.answerSMP([]byte("blue")) != errSMPState {
+		panic("should not answer a question of another session")
+	}
+	a.receive(mustSend(b.sendData()))
+	expectResult(SMP_ABORTED)
+
+	// the new session has its own id, and runs its own SMP
+	if bytes.Equal(a.current.sessionID(), a.previous.sessionID()) {
+		panic("sessions should have different ids")
+	}
+	must(a.startSMP("favourite color?", []byte("blue")))
+	run("blue")
+	expectResult(SMP_SUCCEEDED)
+}
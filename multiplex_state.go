@@ -0,0 +1,204 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// sendPlaintext sends text unencrypted. It carries a whitespace tag with our
+// versions when the policy says so, and we are not encrypting yet.
+func (e *Entity) sendPlaintext(text string) (Msg, error) {
+	if e.policy.requireEncryption {
+		return Msg{}, errRequireEncryption
+	}
+	if e.policy.sendWhitespaceTag && e.msgState == MSGSTATE_PLAINTEXT {
+		text += whitespaceTag(e.policy.allowedVersions())
+	}
+	toSend := Msg{mtype: PT, sender: e.name, text: text}
+	e.traceMsg(EVENT_SEND, toSend)
+	return toSend, nil
+}
+
+// receivePlaintext warns when the peer did not encrypt although we expected
+// them to, and starts a DAKE when they told us they can.
+func (e *Entity) receivePlaintext(m Msg) {
+	_, versions, tagged := parseWhitespaceTag(m.text)
+	if e.msgState != MSGSTATE_PLAINTEXT || e.policy.requireEncryption {
+		e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "received an unencrypted message"})
+	}
+	if tagged && e.msgState == MSGSTATE_PLAINTEXT {
+		e.startDAKE(versions)
+	}
+}
+
+// leaveFinished goes back to PLAINTEXT when a new DAKE starts after the
+// peer ended the session.
+func (e *Entity) leaveFinished() {
+	if e.msgState == MSGSTATE_FINISHED {
+		e.setMsgState(MSGSTATE_PLAINTEXT)
+	}
+}
+
+func testMsgState() {
+	a, b := initialize()
+	expectStates := func(sa, sb MsgState) {
+		if a.msgState != sa || b.msgState != sb {
+			panic("should be " + msgStateNames[sa] + " and " + msgStateNames[sb] + ", got " + msgStateNames[a.msgState] + " and " + msgStateNames[b.msgState])
+		}
+	}
+	rec := &recordTracer{}
+	b.tracer = rec
+
+	expectStates(MSGSTATE_PLAINTEXT, MSGSTATE_PLAINTEXT)
+	if _, err := a.sendData(); err != errNoSession || a.currentRid() != -1 {
+		panic("should not send data outside of an encrypted session")
+	}
+
+	b.receive(a.query())
+	a.receive(b.sendP1())
+	p2 := mustSend(a.sendP2())
+	expectStates(MSGSTATE_ENCRYPTED, MSGSTATE_PLAINTEXT)
+
+	// Bob has no session until P2 arrives, so he reads early data then
+	b.receive(mustSend(a.sendData()))
+	if countEvents(rec, EVENT_REJECT) != 0 || countEvents(rec, EVENT_DECRYPT_OK) != 0 {
+		panic("should keep data of the DAKE we are in for later")
+	}
+	b.receive(p2)
+	expectStates(MSGSTATE_ENCRYPTED, MSGSTATE_ENCRYPTED)
+	if countEvents(rec, EVENT_DECRYPT_OK) != 1 {
+		panic("should read early data once the DAKE is done")
+	}
+	testSyncDataMessages(a, b)
+
+	// data of no DAKE at all is rejected
+	c, _ := initialize()
+	c.tracer = rec
+	c.receive(mustSend(a.sendData()))
+	if countEvents(rec, EVENT_REJECT) != 1 {
+		panic("should reject data outside of an encrypted session")
+	}
+
+	// a new DAKE keeps the session encrypted
+	testSyncDAKE(a, b)
+	expectStates(MSGSTATE_ENCRYPTED, MSGSTATE_ENCRYPTED)
+	testSyncDataMessages(a, b)
+
+	// Alice ends the session
+	a.outgoing = append(a.outgoing, tlv{TLV_DISCONNECTED, nil})
+	b.receive(mustSend(a.sendData()))
+	expectStates(MSGSTATE_ENCRYPTED, MSGSTATE_FINISHED)
+	if _, err := b.sendData(); err != errNoSession {
+		panic("should not send data outside of an encrypted session")
+	}
+	b.receive(mustSend(a.sendData()))
+	if countEvents(rec, EVENT_REJECT) != 2 {
+		panic("should reject data after the session finished")
+	}
+
+	// until they start a new one
+	b.receive(a.query())
+	expectStates(MSGSTATE_ENCRYPTED, MSGSTATE_PLAINTEXT)
+	a.receive(b.sendP1())
+	b.receive(mustSend(a.sendP2()))
+	expectStates(MSGSTATE_ENCRYPTED, MSGSTATE_ENCRYPTED)
+	testSyncDataMessages(a, b)
+	b.tracer = nil
+}
+
+// endSession sends the peer a last data message, which tells them we are
+// done and reveals the MAC keys we did not reveal yet. Every key of the
+// session is forgotten then, and we go back to PLAINTEXT.
+func (e *Entity) endSession() (Msg, error) {
+	e.outgoing = append(e.outgoing, tlv{TLV_DISCONNECTED, nil})
+	toSend, err := e.sendData()
+	if err != nil {
+		e.outgoing = e.outgoing[:len(e.outgoing)-1]
+		return Msg{}, err
+	}
+	e.wipeSession()
+	e.setMsgState(MSGSTATE_PLAINTEXT)
+	return toSend, nil
+}
+
+// wipeSession forgets every keychain, and whatever was in flight.
+func (e *Entity) wipeSession() {
+	for _, kc := range []*keychain{e.previous, e.current, e.pending} {
+		if kc != nil {
+			kc.wipe()
+		}
+	}
+	e.previous, e.current, e.pending = nil, nil, nil
+	e.dropLegacy()
+	e.outgoing, e.macsToReveal = nil, nil
+	e.unread, e.resyncing, e.unreadSince, e.sent = nil, false, time.Time{}, nil
+	if e.smp.state != SMPSTATE_EXPECT1 {
+		e.smp.abort()
+	}
+	e.setAuthState(AUTHSTATE_NONE)
+	e.trace(event{kind: EVENT_NOTE, ssid: e.ssid, note: "session wiped"})
+}
+
+func testEndSession(a, b *Entity) {
+	testSyncDataMessages(a, b)
+	b.receive(mustSend(a.sendData())) // so that Bob sends in a new ratchet next
+
+	// Alice reveals the MAC keys of what she received since she last sent
+	var macs []key
+	lateFromBob := mustSend(b.sendData())
+	for i := 0; i < 2; i++ {
+		m := mustSend(b.sendData())
+		macs = append(macs, b.current.macKey(b.current.retriveChainkey(m.rid, m.mid)))
+		a.receive(m)
+	}
+	m := mustSend(a.sendData())
+	if len(m.revealed) != 2 || !bytes.Equal(m.revealed[0], macs[0]) || !bytes.Equal(m.revealed[1], macs[1]) {
+		panic("should reveal the MAC keys of the messages received")
+	}
+	b.receive(m)
+	lateFromAlice := mustSend(a.sendData())
+
+	// a new DAKE is halfway when Alice ends the session
+	b.receive(a.query())
+	p1 := b.sendP1()
+	a.receive(p1)
+	a.receive(mustSend(b.sendData()))
+
+	if a.pending == nil {
+		panic("Alice should be halfway a DAKE")
+	}
+	secrets := append(append(append([]key{}, a.current.R...), a.current.Ca...), a.current.Cb...)
+	end := mustSend(a.endSession())
+	if len(end.revealed) != 1 {
+		panic("should reveal the remaining MAC keys when ending the session")
+	}
+	for _, k := range secrets {
+		if !bytes.Equal(k, make([]byte, len(k))) {
+			panic("should overwrite the keys of the session")
+		}
+	}
+	if a.previous != nil || a.current != nil || a.pending != nil || a.msgState != MSGSTATE_PLAINTEXT {
+		panic("Alice should forget the session")
+	}
+
+	b.receive(end)
+	if b.previous != nil || b.current != nil || b.pending != nil || b.msgState != MSGSTATE_FINISHED || b.AuthState != AUTHSTATE_NONE {
+		panic("Bob should forget the session and finish")
+	}
+
+	// late messages are rejected, not decrypted with keys that are gone
+	rec := &recordTracer{}
+	a.tracer, b.tracer = rec, rec
+	a.receive(lateFromBob)
+	b.receive(lateFromAlice)
+	if countEvents(rec, EVENT_REJECT) != 2 || countEvents(rec, EVENT_DECRYPT_OK) != 0 {
+		panic("should reject data after the session ended")
+	}
+	a.tracer, b.tracer = nil, nil
+
+	testSyncDAKE(a, b)
+	testSyncDataMessages(a, b)
+}
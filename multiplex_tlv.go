@@ -0,0 +1,215 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// receiveTLVs runs the TLVs of a data message of the session ssid, which we
+// decrypted with ck of kc.
+func (e *Entity) receiveTLVs(tlvs []tlv, ssid int, kc *keychain, ck key) {
+	for _, t := range tlvs {
+		switch t.typ {
+		case TLV_PADDING:
+		case TLV_DISCONNECTED:
+			e.setMsgState(MSGSTATE_FINISHED)
+		case TLV_SMP1, TLV_SMP1Q, TLV_SMP2, TLV_SMP3, TLV_SMP4, TLV_SMP_ABORT:
+			e.receiveSMP(t, ssid)
+		case TLV_RETRANSMIT:
+			n, err := parseRetransmitTLV(t)
+			if err != nil {
+				e.reject(err)
+				continue
+			}
+			e.retransmit(n, kc)
+		case TLV_EXTRA_KEY:
+			usage, context, err := parseExtraKeyTLV(t)
+			if err == nil && kc == nil { // in OTRv3 data messages
+				err = errNoExtraKey
+			}
+			if err != nil {
+				e.reject(err)
+				continue
+			}
+			if e.onExtraKey != nil {
+				e.onExtraKey(usage, context, kc.extraKey(ck))
+			}
+		default:
+			if err := e.tlvHandlers.dispatch(t); err != nil {
+				e.reject(err)
+			}
+		}
+	}
+}
+
+// registerTLV has h called with every TLV of type typ we receive. Types
+// below TLV_CUSTOM belong to the protocol.
+func (e *Entity) registerTLV(typ uint16, h tlvHandler) {
+	e.tlvHandlers.register(typ, h)
+}
+
+// sendTLV sends t, a TLV of the application, in our next data message.
+func (e *Entity) sendTLV(t tlv) error {
+	if t.typ < TLV_CUSTOM {
+		panic("TLV type is reserved.")
+	}
+	if !t.fits() {
+		return errTLVTooLong
+	}
+	e.outgoing = append(e.outgoing, t)
+	return nil
+}
+
+func testTLVs(a, b *Entity) {
+	var got []string
+	b.registerTLV(TLV_CUSTOM, func(t tlv) error {
+		got = append(got, string(t.value))
+		return nil
+	})
+	b.registerTLV(TLV_CUSTOM+1, func(t tlv) error {
+		return errMalformedTLV
+	})
+	expectPanic("TLV type is already registered.", func() { b.registerTLV(TLV_CUSTOM, nil) })
+	expectPanic("TLV type is reserved.", func() { b.registerTLV(TLV_EXTRA_KEY, nil) })
+	expectPanic("TLV type is reserved.", func() { a.sendTLV(tlv{TLV_DISCONNECTED, nil}) })
+
+	for _, enc := range [][]byte{{0}, {0, 1, 0}, {0, 1, 0, 2, 42}} {
+		if _, err := decodeTLVs(enc); err != errMalformedTLV {
+			panic("should not decode a truncated TLV")
+		}
+	}
+
+	// padding, unknown types and types we reject do not stop the others
+	a.padding = 256
+	must(a.sendTLV(tlv{TLV_CUSTOM, []byte("hello")}))
+	must(a.sendTLV(tlv{TLV_CUSTOM + 2, []byte("unknown")}))
+	must(a.sendTLV(tlv{TLV_CUSTOM + 1, nil}))
+	must(a.sendTLV(tlv{TLV_CUSTOM, []byte("world")}))
+	m := mustSend(a.sendData())
+	if len(m.ciphertext)-len(b.provider().seal(m.encKey, nil)) != 256 {
+		panic("should pad the plaintext")
+	}
+
+	rec := &recordTracer{}
+	b.tracer = rec
+	b.receive(m)
+	if fmt.Sprint(got) != "[hello world]" {
+		panic("should get the TLVs of the application in order, got " + fmt.Sprint(got))
+	}
+	if countEvents(rec, EVENT_REJECT) != 1 {
+		panic("should reject the TLV its handler failed")
+	}
+
+	// a malformed encoding rejects the whole message
+	got = nil
+	m = mustSend(a.sendData())
+	enc, err := encodeTLVs([]tlv{{TLV_CUSTOM, []byte("lost")}})
+	must(err)
+	m.ciphertext = a.provider().seal(m.encKey, enc[:6])
+	b.receive(m)
+	if got != nil || countEvents(rec, EVENT_REJECT) != 2 {
+		panic("should reject a malformed TLV encoding")
+	}
+	b.tracer = nil
+
+	// a value too long for its length is refused, and nothing goes out
+	if a.sendTLV(tlv{TLV_CUSTOM, make([]byte, 0x10000)}) != errTLVTooLong || len(a.outgoing) != 0 {
+		panic("should refuse a TLV value longer than 0xffff")
+	}
+	if a.startSMP(string(make([]byte, 0x10000)), []byte("blue")) != errTLVTooLong || len(a.outgoing) != 0 || a.smp.state != SMPSTATE_EXPECT1 {
+		panic("should refuse an SMP question too long for its TLV")
+	}
+	a.padding = 0x20000
+	if _, err := a.sendData(); err != errTLVTooLong {
+		panic("should refuse padding longer than 0xffff")
+	}
+	a.padding = 0
+	testSyncDataMessages(a, b)
+}
+
+// sendExtraKey sends a data message which tells the peer to use its extra
+// symmetric key for usage and context, and returns the key.
+func (e *Entity) sendExtraKey(usage uint32, context []byte) (Msg, key, error) {
+	if e.version != '4' || e.readyToSend() != nil || e.current == nil {
+		return Msg{}, nil, errNoExtraKey
+	}
+	e.outgoing = append(e.outgoing, extraKeyTLV(usage, context))
+	m, err := e.sendData()
+	if err != nil {
+		e.outgoing = e.outgoing[:len(e.outgoing)-1]
+		return Msg{}, nil, err
+	}
+	return m, e.current.extraKey(e.current.retriveChainkey(m.rid, m.mid)), nil
+}
+
+func testExtraKey(a, b *Entity) {
+	type extraKey struct {
+		usage    uint32
+		context  string
+		k        key
+		rid, mid int
+	}
+	var got []extraKey
+	var last Msg
+	b.onExtraKey = func(usage uint32, context []byte, k key) {
+		got = append(got, extraKey{usage, string(context), k, last.rid, last.mid})
+	}
+	receive := func(m Msg) {
+		last = m
+		b.receive(m)
+	}
+
+	var sent []extraKey
+	send := func(usage uint32, context string) Msg {
+		m, k, err := a.sendExtraKey(usage, []byte(context))
+		if err != nil {
+			panic(err)
+		}
+		if len(k) != 32 {
+			panic("extra keys should have 32 bytes")
+		}
+		sent = append(sent, extraKey{usage, context, k, m.rid, m.mid})
+		return m
+	}
+
+	c, _ := initialize()
+	if _, _, err := c.sendExtraKey(1, nil); err != errNoExtraKey || len(c.outgoing) != 0 {
+		panic("should need an OTRv4 session for extra keys")
+	}
+
+	receive(send(1, "photo.jpg"))
+	receive(send(1, "photo.jpg")) // a follow up: same usage, another key
+	a.receive(mustSend(b.sendData()))
+	m1 := send(2, "") // a new ratchet
+	m2 := send(1, "song.mp3")
+	receive(m2) // out of order
+	receive(m1)
+	sent[2], sent[3] = sent[3], sent[2]
+
+	if len(got) != len(sent) {
+		panic("Bob should get every extra key")
+	}
+	seen := map[string]bool{}
+	for i := range sent {
+		if got[i].usage != sent[i].usage || got[i].context != sent[i].context || !bytes.Equal(got[i].k, sent[i].k) || got[i].rid != sent[i].rid || got[i].mid != sent[i].mid {
+			panic(fmt.Sprintf("Bob should get the extra key Alice sent: %v, got %v", sent[i], got[i]))
+		}
+		if seen[string(sent[i].k)] {
+			panic("each message should have its own extra key")
+		}
+		seen[string(sent[i].k)] = true
+	}
+
+	// an extra key TLV without a usage is rejected
+	rec := &recordTracer{}
+	b.tracer = rec
+	a.outgoing = append(a.outgoing, tlv{TLV_EXTRA_KEY, []byte{0, 1}})
+	receive(mustSend(a.sendData()))
+	if len(got) != len(sent) || countEvents(rec, EVENT_REJECT) != 1 {
+		panic("should reject a malformed extra key TLV")
+	}
+	b.tracer = nil
+}
@@ -0,0 +1,107 @@
+//go:build multiplex
+// +build multiplex
+
+package main
+
+import "fmt"
+
+func (e *Entity) query() Msg {
+	toSend := Msg{mtype: Q, sender: e.name, text: queryString(e.policy.allowedVersions())}
+	e.traceMsg(EVENT_SEND, toSend)
+	e.leaveFinished()
+	return toSend
+}
+
+func (e *Entity) receiveQ(m Msg) {
+	versions, ok := parseQuery(m.text)
+	if !ok {
+		e.reject(errNoCommonVersion)
+		return
+	}
+	e.startDAKE(versions)
+}
+
+func testVersionNegotiation() {
+	for _, c := range []struct {
+		ours, theirs string
+		want         byte
+	}{
+		{"", "4", '4'},
+		{"34", "432", '4'},
+		{"34", "23", '3'},
+		{"3", "4", 0},
+	} {
+		v, err := policy{versions: c.ours}.highestCommon(c.theirs)
+		if v != c.want || (err != nil) != (c.want == 0) {
+			panic(fmt.Sprintf("%q and %q should agree on %q, got %q", c.ours, c.theirs, c.want, v))
+		}
+	}
+	if versions, ok := parseQuery("?OTRv43?"); !ok || versions != "43" {
+		panic("should parse the versions of a query")
+	}
+	if text, versions, ok := parseWhitespaceTag("hi" + whitespaceTag("34") + " there"); !ok || text != "hi there" || versions != "34" {
+		panic("should parse the versions of a whitespace tag")
+	}
+
+	a, b := initialize()
+	rec := &recordTracer{}
+	a.tracer, b.tracer = rec, rec
+
+	// no version in common
+	b.policy.versions = "3"
+	b.receive(a.query())
+	if b.pending != nil || countEvents(rec, EVENT_REJECT) != 1 {
+		panic("should not start a DAKE without a version in common")
+	}
+
+	// Bob picks the highest version in common, which Alice must allow
+	a.policy.versions, b.policy.versions = "34", "34"
+	b.receive(a.query())
+	p1 := b.sendP1()
+	if p1.version != '4' {
+		panic("should pick the highest version in common")
+	}
+	a.policy.versions = "3"
+	a.receive(p1)
+	if a.pending != nil || countEvents(rec, EVENT_REJECT) != 2 {
+		panic("should not accept a P1 of a version we do not allow")
+	}
+
+	// the versions of the query are signed in P1, so that an attacker can
+	// change neither them nor the version Bob picked
+	a.policy.versions = "34"
+	q := a.query()
+	q.text = queryString("4")
+	b.receive(q)
+	a.receive(b.sendP1())
+	b.receive(a.query())
+	p1 = b.sendP1()
+	p1.versions = "4"
+	a.receive(p1)
+	if a.pending != nil || countEvents(rec, EVENT_REJECT) != 4 {
+		panic("should not accept a P1 which answers other versions than ours")
+	}
+
+	// a whitespace tag starts a DAKE too
+	a.policy = policy{sendWhitespaceTag: true}
+	pt := mustSend(a.sendPlaintext("hi"))
+	if _, versions, ok := parseWhitespaceTag(pt.text); !ok || versions != "4" {
+		panic("should tag plaintext messages with our versions")
+	}
+	b.receive(pt)
+	a.receive(b.sendP1())
+	b.receive(mustSend(a.sendP2()))
+	if a.msgState != MSGSTATE_ENCRYPTED || b.msgState != MSGSTATE_ENCRYPTED || a.version != '4' || b.version != '4' {
+		panic("a whitespace tag should start a DAKE")
+	}
+	testSyncDataMessages(a, b)
+	if pt = mustSend(a.sendPlaintext("hi again")); pt.text != "hi again" {
+		panic("should not tag plaintext messages once encrypting")
+	}
+
+	a.policy.requireEncryption = true
+	if _, err := a.sendPlaintext("hi"); err != errRequireEncryption {
+		panic("should not send plaintext when the policy requires encryption")
+	}
+	a.tracer, b.tracer = nil, nil
+}
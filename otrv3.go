@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// OTRv3, so that an Entity can still talk to peers who did not move on:
+// its AKE (DH-Commit, DH-Key, Reveal Signature, Signature) and its key
+// management, where each side keeps its last two DH keys and data messages
+// say which of them they were encrypted with.
+
+// The 1536-bit MODP group of RFC 3526, which OTRv3 does its DH in.
+var (
+	dh1536P, _ = new(big.Int).SetString(""+
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D"+
+		"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F"+
+		"83655D23DCA3AD961C62F356208552BB9ED529077096966D"+
+		"670C354E4ABC9804F1746C08CA237327FFFFFFFFFFFFFFFF", 16)
+	dh1536G = big.NewInt(2)
+)
+
+var (
+	errV3DH        = errors.New("invalid 1536-bit DH value")
+	errV3Commit    = errors.New("revealed DH key does not match the commitment")
+	errV3MAC       = errors.New("bad OTRv3 MAC")
+	errV3Signature = errors.New("bad OTRv3 signature")
+	errV3Malformed = errors.New("malformed OTRv3 message")
+	errV3KeyID     = errors.New("OTRv3 message for keys we do not have")
+	errV3Replay    = errors.New("OTRv3 message replayed")
+)
+
+// v3Msg is what OTRv3 messages carry, besides what every Msg does.
+type v3Msg struct {
+	encGx, hashGx  []byte   // DH-Commit
+	gy             *big.Int // DH-Key
+	r              []byte   // Reveal Signature
+	encSig, macSig []byte   // Reveal Signature and Signature
+
+	// data messages
+	senderKeyID, recipientKeyID uint32
+	nextDH                      *big.Int
+	ctr                         uint64
+	encrypted, mac              []byte
+}
+
+type v3DH struct {
+	priv, pub *big.Int
+}
+
+// generateDH1536 draws a 320 bit exponent, as OTRv3 does.
+func generateDH1536(r io.Reader) v3DH {
+	b := make([]byte, 40)
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic("failed to generate keys.")
+	}
+	priv := new(big.Int).SetBytes(b)
+	return v3DH{priv, new(big.Int).Exp(dh1536G, priv, dh1536P)}
+}
+
+func dh1536Check(pub *big.Int) error {
+	two := big.NewInt(2)
+	if pub == nil || pub.Cmp(two) < 0 || pub.Cmp(new(big.Int).Sub(dh1536P, two)) > 0 {
+		return errV3DH
+	}
+	return nil
+}
+
+func (k v3DH) secret(pub *big.Int) []byte {
+	return mpi(new(big.Int).Exp(pub, k.priv, dh1536P))
+}
+
+func (k v3DH) wipe() {
+	if k.priv != nil {
+		k.priv.SetInt64(0)
+	}
+}
+
+// mpi is the OTR encoding of n: its length in 32 bits, then its bytes.
+func mpi(n *big.Int) []byte {
+	b := new(bytes.Buffer)
+	writeBytes(b, n.Bytes())
+	return b.Bytes()
+}
+
+func readMPI(b []byte) (*big.Int, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errV3Malformed
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return nil, nil, errV3Malformed
+	}
+	return new(big.Int).SetBytes(b[4 : 4+n]), b[4+n:], nil
+}
+
+// aesCTR encrypts and decrypts with AES-128, the top half of the counter
+// being ctr.
+func aesCTR(key []byte, ctr uint64, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv, ctr)
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(out, data)
+	return out
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// v3AKEKeys come from the shared secret s of the AKE, through
+// h2(b) = SHA-256(b || MPI(s)).
+type v3AKEKeys struct {
+	ssid                     []byte
+	c, cPrime                []byte
+	m1, m2, m1Prime, m2Prime []byte
+}
+
+func deriveV3AKEKeys(secbytes []byte) v3AKEKeys {
+	h2 := func(b byte) []byte {
+		h := sha256.Sum256(append([]byte{b}, secbytes...))
+		return h[:]
+	}
+	cs := h2(0x01)
+	return v3AKEKeys{
+		ssid:    h2(0x00)[:8],
+		c:       cs[:16],
+		cPrime:  cs[16:],
+		m1:      h2(0x02),
+		m2:      h2(0x03),
+		m1Prime: h2(0x04),
+		m2Prime: h2(0x05),
+	}
+}
+
+type v3AKEState int
+
+const (
+	V3_AWAITING_DHKEY v3AKEState = iota + 1
+	V3_AWAITING_REVEALSIG
+	V3_AWAITING_SIG
+)
+
+// v3AKE is one run of the AKE, from either side. Bob commits to his DH key
+// first, and reveals it once he has Alice's. Each then signs both DH keys.
+type v3AKE struct {
+	state    v3AKEState
+	our      v3DH
+	theirPub *big.Int
+
+	r             []byte // Bob hides his key with it until the reveal
+	encGx, hashGx []byte // Alice keeps his commitment
+	keys          v3AKEKeys
+}
+
+// commit starts the AKE as Bob.
+func (k *v3AKE) commit(r io.Reader) *v3Msg {
+	k.our = generateDH1536(r)
+	k.r = make([]byte, 16)
+	if _, err := io.ReadFull(r, k.r); err != nil {
+		panic("failed to generate keys.")
+	}
+	gx := mpi(k.our.pub)
+	hash := sha256.Sum256(gx)
+	k.state = V3_AWAITING_DHKEY
+	return &v3Msg{encGx: aesCTR(k.r, 0, gx), hashGx: hash[:]}
+}
+
+// receiveCommit keeps the commitment of Bob as Alice.
+func (k *v3AKE) receiveCommit(m *v3Msg) error {
+	if len(m.encGx) == 0 || len(m.hashGx) != sha256.Size {
+		return errV3Malformed
+	}
+	k.encGx, k.hashGx = m.encGx, m.hashGx
+	return nil
+}
+
+// dhKey answers the commitment with Alice's key.
+func (k *v3AKE) dhKey(r io.Reader) *v3Msg {
+	k.our = generateDH1536(r)
+	k.state = V3_AWAITING_REVEALSIG
+	return &v3Msg{gy: k.our.pub}
+}
+
+// receiveDHKey reveals Bob's key, and signs both.
+func (k *v3AKE) receiveDHKey(r io.Reader, dsaKey *dsa.PrivateKey, m *v3Msg) (*v3Msg, error) {
+	if err := dh1536Check(m.gy); err != nil {
+		return nil, err
+	}
+	k.theirPub = m.gy
+	k.keys = deriveV3AKEKeys(k.our.secret(k.theirPub))
+	enc, mac := k.sign(r, dsaKey, k.keys.c, k.keys.m1, k.keys.m2)
+	k.state = V3_AWAITING_SIG
+	return &v3Msg{r: k.r, encSig: enc, macSig: mac}, nil
+}
+
+// receiveRevealSig checks Bob's key against his commitment, and his
+// signature. Alice is done then.
+func (k *v3AKE) receiveRevealSig(r io.Reader, dsaKey *dsa.PrivateKey, m *v3Msg) (*v3Msg, *dsa.PublicKey, error) {
+	if len(m.r) != 16 {
+		return nil, nil, errV3Malformed
+	}
+	gx := aesCTR(m.r, 0, k.encGx)
+	if hash := sha256.Sum256(gx); !hmac.Equal(hash[:], k.hashGx) {
+		return nil, nil, errV3Commit
+	}
+	theirPub, rest, err := readMPI(gx)
+	if err != nil || len(rest) != 0 {
+		return nil, nil, errV3Malformed
+	}
+	if err := dh1536Check(theirPub); err != nil {
+		return nil, nil, err
+	}
+	k.theirPub = theirPub
+	k.keys = deriveV3AKEKeys(k.our.secret(k.theirPub))
+
+	their, err := k.verify(m.encSig, m.macSig, k.keys.c, k.keys.m1, k.keys.m2)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, mac := k.sign(r, dsaKey, k.keys.cPrime, k.keys.m1Prime, k.keys.m2Prime)
+	k.state = 0
+	return &v3Msg{encSig: enc, macSig: mac}, their, nil
+}
+
+// receiveSig checks Alice's signature. Bob is done then.
+func (k *v3AKE) receiveSig(m *v3Msg) (*dsa.PublicKey, error) {
+	their, err := k.verify(m.encSig, m.macSig, k.keys.cPrime, k.keys.m1Prime, k.keys.m2Prime)
+	if err != nil {
+		return nil, err
+	}
+	k.state = 0
+	return their, nil
+}
+
+// The DH key of the AKE is the first of each side.
+const v3AKEKeyID = 1
+
+// dsaFingerprint is the SHA-1 of a DSA public key, as OTRv3 shows it.
+func dsaFingerprint(pub *dsa.PublicKey) []byte {
+	h := sha1.Sum(dsaPublicBytes(pub))
+	return h[:]
+}
+
+func dsaPublicBytes(pub *dsa.PublicKey) []byte {
+	b := new(bytes.Buffer)
+	for _, n := range []*big.Int{pub.P, pub.Q, pub.G, pub.Y} {
+		writeBytes(b, n.Bytes())
+	}
+	return b.Bytes()
+}
+
+// signedM is M = MAC_m1(signer's DH key, the other DH key, signer's DSA key,
+// key id).
+func signedM(m1 []byte, signerDH, otherDH *big.Int, pub *dsa.PublicKey, keyID uint32) []byte {
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, keyID)
+	return hmacSHA256(m1, mpi(signerDH), mpi(otherDH), dsaPublicBytes(pub), id)
+}
+
+// sign makes X = our DSA key || key id || sig(M), encrypted with c and MACed
+// with m2.
+func (k *v3AKE) sign(r io.Reader, dsaKey *dsa.PrivateKey, c, m1, m2 []byte) (enc, mac []byte) {
+	pub := &dsaKey.PublicKey
+	rs, ss, err := dsa.Sign(r, dsaKey, dsaHash(pub, signedM(m1, k.our.pub, k.theirPub, pub, v3AKEKeyID)))
+	if err != nil {
+		panic("failed to sign the AKE.")
+	}
+	size := pub.Q.BitLen() / 8
+
+	x := bytes.NewBuffer(dsaPublicBytes(pub))
+	binary.Write(x, binary.BigEndian, uint32(v3AKEKeyID))
+	x.Write(rs.FillBytes(make([]byte, size)))
+	x.Write(ss.FillBytes(make([]byte, size)))
+
+	enc = aesCTR(c, 0, x.Bytes())
+	return enc, hmacSHA256(m2, enc)[:20]
+}
+
+func (k *v3AKE) verify(enc, mac, c, m1, m2 []byte) (*dsa.PublicKey, error) {
+	if !hmac.Equal(mac, hmacSHA256(m2, enc)[:20]) {
+		return nil, errV3MAC
+	}
+	x := aesCTR(c, 0, enc)
+
+	var n [4]*big.Int
+	var err error
+	for i := range n {
+		if n[i], x, err = readMPI(x); err != nil {
+			return nil, err
+		}
+	}
+	pub := &dsa.PublicKey{Parameters: dsa.Parameters{P: n[0], Q: n[1], G: n[2]}, Y: n[3]}
+	size := pub.Q.BitLen() / 8
+	if !dsaQValid(pub) || len(x) != 4+2*size {
+		return nil, errV3Malformed
+	}
+	keyID := binary.BigEndian.Uint32(x)
+	rs := new(big.Int).SetBytes(x[4 : 4+size])
+	ss := new(big.Int).SetBytes(x[4+size:])
+	if keyID != v3AKEKeyID || !dsa.Verify(pub, dsaHash(pub, signedM(m1, k.theirPub, k.our.pub, pub, keyID)), rs, ss) {
+		return nil, errV3Signature
+	}
+	return pub, nil
+}
+
+// v3DataKeys are the keys of the data messages between a pair of DH keys.
+// Whoever has the larger public key sends with 0x01 and receives with 0x02.
+type v3DataKeys struct {
+	sendAES, sendMAC, recvAES, recvMAC []byte
+}
+
+func deriveV3DataKeys(our v3DH, theirPub *big.Int) v3DataKeys {
+	secbytes := our.secret(theirPub)
+	sendByte, recvByte := byte(0x01), byte(0x02)
+	if our.pub.Cmp(theirPub) < 0 {
+		sendByte, recvByte = recvByte, sendByte
+	}
+	aesKey := func(b byte) []byte {
+		h := sha1.Sum(append([]byte{b}, secbytes...))
+		return h[:16]
+	}
+	macKey := func(aesKey []byte) []byte {
+		h := sha1.Sum(aesKey)
+		return h[:]
+	}
+	k := v3DataKeys{sendAES: aesKey(sendByte), recvAES: aesKey(recvByte)}
+	k.sendMAC, k.recvMAC = macKey(k.sendAES), macKey(k.recvAES)
+	return k
+}
+
+// v3Keys is the key management of an OTRv3 session. We send with our
+// second to last key, to their last one, and tell them our last one. Once
+// they use our last key we make a new one, and once they use their last
+// key we learn their next one. The MAC keys of pairs we forget are
+// revealed in our next message.
+type v3Keys struct {
+	ourKeyID   uint32
+	ours       map[uint32]v3DH // ourKeyID-1 and ourKeyID
+	theirKeyID uint32
+	theirs     map[uint32]*big.Int // theirKeyID-1 and theirKeyID
+
+	ctr      uint64               // top half of the counter of what we send
+	received map[[2]uint32]uint64 // last counter received with each pair
+	recvMACs map[[2]uint32][]byte // of the pairs we received with
+	revealed [][]byte             // for our next message
+
+	ssid []byte // of the AKE
+}
+
+func newV3Keys(r io.Reader, our v3DH, theirPub *big.Int) *v3Keys {
+	return &v3Keys{
+		ourKeyID:   v3AKEKeyID + 1,
+		ours:       map[uint32]v3DH{v3AKEKeyID: our, v3AKEKeyID + 1: generateDH1536(r)},
+		theirKeyID: v3AKEKeyID,
+		theirs:     map[uint32]*big.Int{v3AKEKeyID: theirPub},
+		received:   make(map[[2]uint32]uint64),
+		recvMACs:   make(map[[2]uint32][]byte),
+	}
+}
+
+func v3MACData(m *v3Msg) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, m.senderKeyID)
+	binary.Write(b, binary.BigEndian, m.recipientKeyID)
+	b.Write(mpi(m.nextDH))
+	binary.Write(b, binary.BigEndian, m.ctr)
+	writeBytes(b, m.encrypted)
+	return b.Bytes()
+}
+
+func (k *v3Keys) seal(plaintext []byte) (m *v3Msg, revealed [][]byte) {
+	keys := deriveV3DataKeys(k.ours[k.ourKeyID-1], k.theirs[k.theirKeyID])
+	k.ctr++
+	m = &v3Msg{
+		senderKeyID:    k.ourKeyID - 1,
+		recipientKeyID: k.theirKeyID,
+		nextDH:         k.ours[k.ourKeyID].pub,
+		ctr:            k.ctr,
+		encrypted:      aesCTR(keys.sendAES, k.ctr, plaintext),
+	}
+	h := hmac.New(sha1.New, keys.sendMAC)
+	h.Write(v3MACData(m))
+	m.mac = h.Sum(nil)
+
+	revealed, k.revealed = k.revealed, nil
+	return m, revealed
+}
+
+// open decrypts m, and moves the keys on when it says so.
+func (k *v3Keys) open(r io.Reader, m *v3Msg) ([]byte, error) {
+	our, ok1 := k.ours[m.recipientKeyID]
+	theirPub, ok2 := k.theirs[m.senderKeyID]
+	if !ok1 || !ok2 {
+		return nil, errV3KeyID
+	}
+	pair := [2]uint32{m.recipientKeyID, m.senderKeyID}
+	keys := deriveV3DataKeys(our, theirPub)
+
+	h := hmac.New(sha1.New, keys.recvMAC)
+	h.Write(v3MACData(m))
+	if !hmac.Equal(h.Sum(nil), m.mac) {
+		return nil, errV3MAC
+	}
+	if m.ctr <= k.received[pair] {
+		return nil, errV3Replay
+	}
+	if m.senderKeyID == k.theirKeyID {
+		if err := dh1536Check(m.nextDH); err != nil {
+			return nil, err
+		}
+	}
+	k.received[pair] = m.ctr
+	k.recvMACs[pair] = keys.recvMAC
+	plaintext := aesCTR(keys.recvAES, m.ctr, m.encrypted)
+
+	if m.recipientKeyID == k.ourKeyID {
+		k.forget(k.ourKeyID-1, 0)
+		k.ourKeyID++
+		k.ours[k.ourKeyID] = generateDH1536(r)
+	}
+	if m.senderKeyID == k.theirKeyID {
+		k.forget(0, k.theirKeyID-1)
+		k.theirKeyID++
+		k.theirs[k.theirKeyID] = m.nextDH
+	}
+	return plaintext, nil
+}
+
+// forget drops our key ourID or their key theirID, and the MAC keys of the
+// pairs they were in go out with our next message.
+func (k *v3Keys) forget(ourID, theirID uint32) {
+	if our, ok := k.ours[ourID]; ok {
+		our.wipe()
+		delete(k.ours, ourID)
+	}
+	delete(k.theirs, theirID)
+	for pair, mac := range k.recvMACs {
+		if pair[0] == ourID || pair[1] == theirID {
+			k.revealed = append(k.revealed, mac)
+			delete(k.recvMACs, pair)
+			delete(k.received, pair)
+		}
+	}
+}
+
+func (k *v3Keys) wipe() {
+	for id, our := range k.ours {
+		our.wipe()
+		delete(k.ours, id)
+	}
+	for pair, mac := range k.recvMACs {
+		wipeKeys(mac)
+		delete(k.recvMACs, pair)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// A policy says which protocol versions an Entity speaks and how eager it
+// is to encrypt.
+type policy struct {
+	versions          string // allowed versions, like "43"; "4" when empty
+	requireEncryption bool   // never send a plaintext message
+	sendWhitespaceTag bool   // advertise our versions in plaintext messages
+	errorStartAKE     bool   // answer an error message from the peer with a query
+	retransmit        bool   // ask the peer to send again what we lost to a desync
+}
+
+var (
+	errNoCommonVersion   = errors.New("no protocol version in common")
+	errVersionsChanged   = errors.New("P1 answers versions we did not offer")
+	errRequireEncryption = errors.New("the policy requires encryption")
+)
+
+func (p policy) allowedVersions() string {
+	if p.versions == "" {
+		return "4"
+	}
+	return p.versions
+}
+
+func (p policy) allows(version byte) bool {
+	return strings.IndexByte(p.allowedVersions(), version) >= 0
+}
+
+// highestCommon picks the version we run with a peer who speaks theirs.
+func (p policy) highestCommon(theirs string) (byte, error) {
+	best := byte(0)
+	for i := 0; i < len(theirs); i++ {
+		if v := theirs[i]; v > best && p.allows(v) {
+			best = v
+		}
+	}
+	if best == 0 {
+		return 0, errNoCommonVersion
+	}
+	return best, nil
+}
+
+// queryString is the query message which advertises versions, as in
+// "?OTRv43?".
+func queryString(versions string) string {
+	return "?OTRv" + versions + "?"
+}
+
+func parseQuery(text string) (versions string, ok bool) {
+	i := strings.Index(text, "?OTRv")
+	if i < 0 {
+		return "", false
+	}
+	rest := text[i+len("?OTRv"):]
+	j := strings.IndexByte(rest, '?')
+	if j < 0 {
+		return "", false
+	}
+	return rest[:j], true
+}
+
+// Whitespace tags advertise versions at the end of a plaintext message: the
+// base tag, followed by one 8 character tag per version.
+const whitespaceBase = "\x20\x09\x20\x20\x09\x09\x09\x09\x20\x09\x20\x09\x20\x09\x20\x20"
+
+var whitespaceVersions = map[byte]string{
+	'2': "\x20\x20\x09\x09\x20\x20\x09\x20",
+	'3': "\x20\x20\x09\x09\x20\x20\x09\x09",
+	'4': "\x20\x20\x09\x09\x20\x09\x20\x20",
+}
+
+func whitespaceTag(versions string) string {
+	tag := whitespaceBase
+	for i := 0; i < len(versions); i++ {
+		tag += whitespaceVersions[versions[i]]
+	}
+	return tag
+}
+
+// parseWhitespaceTag finds the tag in text, and returns text without it and
+// the versions it advertises. The tag ends where no version tag we know
+// follows.
+func parseWhitespaceTag(text string) (plain, versions string, ok bool) {
+	i := strings.Index(text, whitespaceBase)
+	if i < 0 {
+		return text, "", false
+	}
+	rest := text[i+len(whitespaceBase):]
+next:
+	for len(rest) >= 8 {
+		for v, tag := range whitespaceVersions {
+			if rest[:8] == tag {
+				versions += string(v)
+				rest = rest[8:]
+				continue next
+			}
+		}
+		break
+	}
+	return text[:i] + rest, versions, true
+}
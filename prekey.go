@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/twstrike/ed448"
+)
+
+// Identity keys sign, so they are always ed448, whatever the curve of the
+// ratchet is.
+var identityCurve = ed448.NewCurve()
+
+// A prekeyMsg is published by Bob so that Alice can start a conversation
+// with him while he is offline. Its ephemeral key y is used only once, the
+// shared prekey is signed with his identity key and used by every prekeyMsg.
+// The whole message is signed too, so that only Bob can publish it.
+type prekeyMsg struct {
+	id              uint32
+	instanceTag     uint32
+	profile         *clientProfile
+	y               pubkey
+	sharedPrekey    pubkey
+	sharedPrekeySig [112]byte
+	sig             [112]byte
+}
+
+// newInstanceTag picks a tag for a client instance. Tags below 0x100 are
+// reserved.
+func newInstanceTag(r io.Reader) uint32 {
+	var b [4]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			panic("failed to generate instance tag.")
+		}
+		if tag := binary.BigEndian.Uint32(b[:]); tag >= 0x100 {
+			return tag
+		}
+	}
+}
+
+func signSharedPrekey(crypto provider, identity seckey, sharedPrekey pubkey) [112]byte {
+	return crypto.sign(identity, sharedPrekey[:])
+}
+
+// body is what the identity key signs: every field but the profile, which
+// is signed on its own.
+func (pm prekeyMsg) body() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, pm.id)
+	binary.Write(b, binary.BigEndian, pm.instanceTag)
+	b.Write(pm.y[:])
+	b.Write(pm.sharedPrekey[:])
+	b.Write(pm.sharedPrekeySig[:])
+	return b.Bytes()
+}
+
+func (pm prekeyMsg) validate(crypto provider, now time.Time) error {
+	if err := pm.profile.validate(crypto, now); err != nil {
+		return err
+	}
+	if pm.instanceTag != pm.profile.instanceTag {
+		return errors.New("prekey message of another instance")
+	}
+	if !crypto.verify(pm.sharedPrekeySig, pm.sharedPrekey[:], pm.profile.identity) {
+		return errors.New("bad shared prekey signature")
+	}
+	if !crypto.verify(pm.sig, pm.body(), pm.profile.identity) {
+		return errors.New("bad prekey message signature")
+	}
+	return nil
+}
+
+// nonInteractiveSecret mixes the DH with the ephemeral key of the prekeyMsg
+// and the DH with the shared prekey into the secret of the first ratchet,
+// together with the identity keys of Alice, who sends the NI message, and
+// of Bob. Alice signs the NI message too, so that Bob knows who he talks to:
+// unlike the ring signature of OTRv4, it is not deniable.
+func nonInteractiveSecret(ephemeral, shared [64]byte, alice, bob pubkey) [64]byte {
+	in := append(append([]byte{}, ephemeral[:]...), shared[:]...)
+	in = append(append(in, alice[:]...), bob[:]...)
+	var secret [64]byte
+	sha3.ShakeSum256(secret[:], in)
+	return secret
+}
+
+// niBody is what Alice signs in a NI message: the message and the prekey
+// message of Bob it answers, from its keys.
+func niBody(dakeBody []byte, y, sharedPrekey, bob pubkey) []byte {
+	b := bytes.NewBuffer(append([]byte{}, dakeBody...))
+	b.Write(y[:])
+	b.Write(sharedPrekey[:])
+	b.Write(bob[:])
+	return b.Bytes()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A prekeyService is where entities publish their prekey messages and fetch
+// the ones of their peers.
+type prekeyService interface {
+	publish(pms []prekeyMsg) error
+	fetch(identity string) ([]prekeyMsg, error)
+}
+
+var (
+	errNoPrekeys = errors.New("no prekey messages for this identity")
+	errNameTaken = errors.New("name published by another identity key")
+)
+
+// prekeyServer is an in-process stand-in for a prekey server. It stores
+// prekey messages per identity key and instance tag and hands out each of
+// them exactly once. A name belongs to the first identity key which
+// publishes under it: prekey messages are signed by it, so nobody else can
+// publish for that name.
+type prekeyServer struct {
+	sync.Mutex
+	owners map[string]pubkey
+	stored map[pubkey]map[uint32][]prekeyMsg
+
+	// notifyLow is called when an instance has fewer than lowWatermark
+	// prekey messages left after a fetch.
+	lowWatermark int
+	notifyLow    func(identity string, instanceTag uint32, left int)
+
+	clock clock // prekey messages must be valid on it
+}
+
+func newPrekeyServer(lowWatermark int) *prekeyServer {
+	return &prekeyServer{
+		owners:       make(map[string]pubkey),
+		stored:       make(map[pubkey]map[uint32][]prekeyMsg),
+		lowWatermark: lowWatermark,
+	}
+}
+
+// publish stores pms, or none of them if any is invalid.
+func (s *prekeyServer) publish(pms []prekeyMsg) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, pm := range pms {
+		if err := pm.validate(defaultProvider(), timeOn(s.clock)); err != nil {
+			return fmt.Errorf("prekey message %d: %s", pm.id, err)
+		}
+		if owner, ok := s.owners[pm.profile.name]; ok && owner != pm.profile.identity {
+			return fmt.Errorf("prekey message %d: %s", pm.id, errNameTaken)
+		}
+	}
+
+	for _, pm := range pms {
+		identity := pm.profile.identity
+		s.owners[pm.profile.name] = identity
+		if s.stored[identity] == nil {
+			s.stored[identity] = make(map[uint32][]prekeyMsg)
+		}
+		s.stored[identity][pm.instanceTag] = append(s.stored[identity][pm.instanceTag], pm)
+	}
+	return nil
+}
+
+// fetch hands out one prekey message for each instance of identity and
+// forgets about them.
+func (s *prekeyServer) fetch(identity string) ([]prekeyMsg, error) {
+	var fetched []prekeyMsg
+	var low []uint32
+
+	s.Lock()
+	owner, ok := s.owners[identity]
+	for tag, pms := range s.stored[owner] {
+		if !ok || len(pms) == 0 {
+			continue
+		}
+		fetched = append(fetched, pms[0])
+		s.stored[owner][tag] = pms[1:]
+		if len(pms)-1 < s.lowWatermark {
+			low = append(low, tag)
+		}
+	}
+	s.Unlock()
+
+	// outside of the lock, so the owner can publish more when notified
+	for _, tag := range low {
+		if s.notifyLow != nil {
+			s.notifyLow(identity, tag, s.remaining(owner, tag))
+		}
+	}
+
+	if len(fetched) == 0 {
+		return nil, errNoPrekeys
+	}
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].instanceTag < fetched[j].instanceTag })
+	return fetched, nil
+}
+
+func (s *prekeyServer) remaining(identity pubkey, instanceTag uint32) int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.stored[identity][instanceTag])
+}
+
+// profileWire is a clientProfile as it goes over HTTP.
+type profileWire struct {
+	Name            string   `json:"name"`
+	InstanceTag     uint32   `json:"instance_tag"`
+	Identity        hexKey   `json:"identity"`
+	Versions        string   `json:"versions"`
+	Expiration      int64    `json:"expiration"`
+	DSAKey          []hexKey `json:"dsa_key,omitempty"` // p, q, g, y
+	TransitionalSig hexKey   `json:"transitional_sig,omitempty"`
+	Sig             hexKey   `json:"sig"`
+}
+
+// prekeyWire is a prekeyMsg as it goes over HTTP.
+type prekeyWire struct {
+	ID              uint32      `json:"id"`
+	InstanceTag     uint32      `json:"instance_tag"`
+	Profile         profileWire `json:"profile"`
+	Y               hexKey      `json:"y"`
+	SharedPrekey    hexKey      `json:"shared_prekey"`
+	SharedPrekeySig hexKey      `json:"shared_prekey_sig"`
+	Sig             hexKey      `json:"sig"`
+}
+
+var errMalformedWire = errors.New("malformed prekey message")
+
+func copyExact(dst []byte, src hexKey) error {
+	if len(src) != len(dst) {
+		return errMalformedWire
+	}
+	copy(dst, src)
+	return nil
+}
+
+func toWire(pm prekeyMsg) prekeyWire {
+	p := pm.profile
+	w := prekeyWire{
+		ID:          pm.id,
+		InstanceTag: pm.instanceTag,
+		Profile: profileWire{
+			Name:            p.name,
+			InstanceTag:     p.instanceTag,
+			Identity:        hexKey(p.identity[:]),
+			Versions:        p.versions,
+			Expiration:      p.expiration.Unix(),
+			TransitionalSig: hexKey(p.transitionalSig),
+			Sig:             hexKey(p.sig[:]),
+		},
+		Y:               hexKey(pm.y[:]),
+		SharedPrekey:    hexKey(pm.sharedPrekey[:]),
+		SharedPrekeySig: hexKey(pm.sharedPrekeySig[:]),
+		Sig:             hexKey(pm.sig[:]),
+	}
+	if p.dsaKey != nil {
+		for _, n := range []*big.Int{p.dsaKey.P, p.dsaKey.Q, p.dsaKey.G, p.dsaKey.Y} {
+			w.Profile.DSAKey = append(w.Profile.DSAKey, hexKey(n.Bytes()))
+		}
+	}
+	return w
+}
+
+func fromWire(w prekeyWire) (pm prekeyMsg, err error) {
+	pm.id = w.ID
+	pm.instanceTag = w.InstanceTag
+	pm.profile = &clientProfile{
+		name:        w.Profile.Name,
+		instanceTag: w.Profile.InstanceTag,
+		versions:    w.Profile.Versions,
+		expiration:  time.Unix(w.Profile.Expiration, 0),
+	}
+
+	switch len(w.Profile.DSAKey) {
+	case 0:
+	case 4:
+		n := make([]*big.Int, 4)
+		for i, b := range w.Profile.DSAKey {
+			n[i] = new(big.Int).SetBytes(b)
+		}
+		pm.profile.dsaKey = &dsa.PublicKey{Parameters: dsa.Parameters{P: n[0], Q: n[1], G: n[2]}, Y: n[3]}
+		pm.profile.transitionalSig = w.Profile.TransitionalSig
+	default:
+		return pm, errMalformedWire
+	}
+
+	for _, f := range []struct {
+		dst []byte
+		src hexKey
+	}{
+		{pm.profile.identity[:], w.Profile.Identity},
+		{pm.profile.sig[:], w.Profile.Sig},
+		{pm.y[:], w.Y},
+		{pm.sharedPrekey[:], w.SharedPrekey},
+		{pm.sharedPrekeySig[:], w.SharedPrekeySig},
+		{pm.sig[:], w.Sig},
+	} {
+		if err := copyExact(f.dst, f.src); err != nil {
+			return pm, err
+		}
+	}
+	return pm, nil
+}
+
+// ServeHTTP exposes the server to clients in other processes:
+//
+//	POST /prekeys             publishes a JSON list of prekey messages
+//	GET  /prekeys/<identity>  fetches one prekey message for each instance
+func (s *prekeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity := strings.TrimPrefix(r.URL.Path, "/prekeys/")
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/prekeys":
+		var wires []prekeyWire
+		if err := json.NewDecoder(r.Body).Decode(&wires); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var pms []prekeyMsg
+		for _, wire := range wires {
+			pm, err := fromWire(wire)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			pms = append(pms, pm)
+		}
+
+		if err := s.publish(pms); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	case r.Method == "GET" && identity != r.URL.Path && identity != "":
+		pms, err := s.fetch(identity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		wires := make([]prekeyWire, len(pms))
+		for i, pm := range pms {
+			wires[i] = toWire(pm)
+		}
+		json.NewEncoder(w).Encode(wires)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listenPrekeyServer serves s over HTTP on localhost, on a port picked by
+// the system unless addr has one.
+func listenPrekeyServer(s *prekeyServer, addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(l, s)
+	return l, nil
+}
+
+// prekeyClient reaches a prekeyServer over HTTP.
+type prekeyClient struct {
+	base string
+}
+
+func (c prekeyClient) publish(pms []prekeyMsg) error {
+	wires := make([]prekeyWire, len(pms))
+	for i, pm := range pms {
+		wires[i] = toWire(pm)
+	}
+	body, err := json.Marshal(wires)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(c.base+"/prekeys", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publishing prekeys: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c prekeyClient) fetch(identity string) ([]prekeyMsg, error) {
+	resp, err := http.Get(c.base + "/prekeys/" + url.PathEscape(identity))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoPrekeys
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching prekeys: %s", resp.Status)
+	}
+
+	var wires []prekeyWire
+	if err := json.NewDecoder(resp.Body).Decode(&wires); err != nil {
+		return nil, err
+	}
+
+	pms := make([]prekeyMsg, len(wires))
+	for i, wire := range wires {
+		if pms[i], err = fromWire(wire); err != nil {
+			return nil, err
+		}
+	}
+	return pms, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// profileLifetime is how long a client profile we sign stays valid.
+var profileLifetime = 14 * 24 * time.Hour
+
+var (
+	errProfileMalformed = errors.New("malformed client profile")
+	errProfileExpired   = errors.New("expired client profile")
+	errProfileSignature = errors.New("bad client profile signature")
+)
+
+// A clientProfile says who an Entity is. It is signed with the identity key,
+// and optionally with the OTRv3 DSA key of the owner during the transition.
+type clientProfile struct {
+	name        string
+	instanceTag uint32
+	identity    pubkey
+	versions    string
+	expiration  time.Time
+
+	dsaKey          *dsa.PublicKey
+	transitionalSig []byte
+
+	sig [112]byte
+}
+
+func writeBytes(b *bytes.Buffer, data []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(data)))
+	b.Write(data)
+}
+
+// transitionalBody is what the DSA key signs: every field.
+func (p *clientProfile) transitionalBody() []byte {
+	b := new(bytes.Buffer)
+	writeBytes(b, []byte(p.name))
+	binary.Write(b, binary.BigEndian, p.instanceTag)
+	b.Write(p.identity[:])
+	writeBytes(b, []byte(p.versions))
+	binary.Write(b, binary.BigEndian, p.expiration.Unix())
+	if p.dsaKey != nil {
+		for _, n := range []*big.Int{p.dsaKey.P, p.dsaKey.Q, p.dsaKey.G, p.dsaKey.Y} {
+			writeBytes(b, n.Bytes())
+		}
+	}
+	return b.Bytes()
+}
+
+// body is what the identity key signs: every field and the transitional
+// signature.
+func (p *clientProfile) body() []byte {
+	b := bytes.NewBuffer(p.transitionalBody())
+	if p.dsaKey != nil {
+		writeBytes(b, p.transitionalSig)
+	}
+	return b.Bytes()
+}
+
+// dsaHash is the SHA-256 of body, cut to the size of Q. Keys whose Q is
+// larger than the hash are malformed: check them with dsaQValid first.
+func dsaHash(p *dsa.PublicKey, body []byte) []byte {
+	h := sha256.Sum256(body)
+	if size := p.Q.BitLen() / 8; size < len(h) {
+		return h[:size]
+	}
+	return h[:]
+}
+
+// dsaQValid tells whether we can sign and verify with the Q of p: a Q of
+// at most 256 bits, as the DSA keys of OTRv3 have.
+func dsaQValid(p *dsa.PublicKey) bool {
+	n := p.Q.BitLen()
+	return n > 0 && n <= 256
+}
+
+// newClientProfile signs a profile which expires at expiration. dsaKey is
+// optional, and the only user of rand.
+func newClientProfile(crypto provider, rand io.Reader, name string, instanceTag uint32, identityPriv seckey, identity pubkey, expiration time.Time, dsaKey *dsa.PrivateKey) *clientProfile {
+	p := &clientProfile{
+		name:        name,
+		instanceTag: instanceTag,
+		identity:    identity,
+		versions:    "4",
+		expiration:  expiration,
+	}
+
+	if dsaKey != nil {
+		if !dsaQValid(&dsaKey.PublicKey) {
+			panic("DSA key with an unsupported Q.")
+		}
+		p.dsaKey = &dsaKey.PublicKey
+		r, s, err := dsa.Sign(rand, dsaKey, dsaHash(p.dsaKey, p.transitionalBody()))
+		if err != nil {
+			panic("failed to sign client profile.")
+		}
+		size := p.dsaKey.Q.BitLen() / 8
+		p.transitionalSig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+
+	p.sig = crypto.sign(identityPriv, p.body())
+	return p
+}
+
+// validate checks a profile we received at now.
+func (p *clientProfile) validate(crypto provider, now time.Time) error {
+	if p == nil || p.name == "" || p.instanceTag < 0x100 || p.identity == (pubkey{}) {
+		return errProfileMalformed
+	}
+	if !strings.Contains(p.versions, "4") {
+		return errProfileMalformed
+	}
+	if p.dsaKey == nil && p.transitionalSig != nil {
+		return errProfileMalformed
+	}
+	if k := p.dsaKey; k != nil && (k.P == nil || k.Q == nil || k.G == nil || k.Y == nil || !dsaQValid(k)) {
+		return errProfileMalformed
+	}
+
+	if !crypto.verify(p.sig, p.body(), p.identity) {
+		return errProfileSignature
+	}
+
+	if p.dsaKey != nil {
+		size := p.dsaKey.Q.BitLen() / 8
+		if len(p.transitionalSig) != 2*size {
+			return errProfileMalformed
+		}
+		r := new(big.Int).SetBytes(p.transitionalSig[:size])
+		s := new(big.Int).SetBytes(p.transitionalSig[size:])
+		if !dsa.Verify(p.dsaKey, dsaHash(p.dsaKey, p.transitionalBody()), r, s) {
+			return errProfileSignature
+		}
+	}
+
+	if !now.Before(p.expiration) {
+		return errProfileExpired
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A scenario is a list of steps run against a fresh Alice (A) and Bob (B).
+//
+//	# comments start with a hash
+//	A query              Alice sends a query, Bob receives it right away
+//	B sendP1 -> p1       Bob sends a P1, which is held as p1
+//	B sendData -> late   Bob sends a data message, which is held as late
+//	A receive p1         Alice receives the held p1
+//	B rid -> r           remember Bob's current rid as r
+//	B expect rid > r     fail unless Bob has ratcheted since
+//	xfail simple         the simple design is not expected to get through
+//
+// A message which is held and never received is lost.
+type scenario struct {
+	name  string
+	steps []step
+	xfail []string // designs expected to fail the scenario
+}
+
+// expectedToFail tells whether this design is not expected to get through.
+func (s *scenario) expectedToFail() bool {
+	for _, d := range s.xfail {
+		if d == designName {
+			return true
+		}
+	}
+	return false
+}
+
+type step struct {
+	line   int
+	text   string
+	who    string
+	action string
+	args   []string
+	hold   string
+}
+
+func parseScenario(name string, r io.Reader) (*scenario, error) {
+	s := &scenario{name: name}
+	lines := bufio.NewScanner(r)
+	for n := 1; lines.Scan(); n++ {
+		text := lines.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if fields := strings.Fields(text); fields[0] == "xfail" {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: usage: xfail <design>...", name, n)
+			}
+			s.xfail = append(s.xfail, fields[1:]...)
+			continue
+		}
+
+		st, err := parseStep(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, n, err)
+		}
+		st.line = n
+		s.steps = append(s.steps, st)
+	}
+	return s, lines.Err()
+}
+
+func parseStep(text string) (step, error) {
+	st := step{text: text}
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[len(fields)-2] == "->" {
+		st.hold = fields[len(fields)-1]
+		fields = fields[:len(fields)-2]
+	}
+	if len(fields) < 2 {
+		return st, fmt.Errorf("incomplete step: %q", text)
+	}
+
+	st.who, st.action, st.args = fields[0], fields[1], fields[2:]
+	if st.who != "A" && st.who != "B" {
+		return st, fmt.Errorf("unknown entity %q, expected A or B", st.who)
+	}
+
+	switch {
+	case scenarioSends[st.action] != nil:
+		if len(st.args) != 0 {
+			return st, fmt.Errorf("%s takes no arguments", st.action)
+		}
+	case st.action == "receive":
+		if len(st.args) != 1 || st.hold != "" {
+			return st, fmt.Errorf("usage: receive <held message>")
+		}
+	case st.action == "rid":
+		if len(st.args) != 0 || st.hold == "" {
+			return st, fmt.Errorf("usage: rid -> <name>")
+		}
+	case st.action == "expect":
+		if len(st.args) != 3 || st.args[0] != "rid" || st.hold != "" {
+			return st, fmt.Errorf("usage: expect rid <op> <name>")
+		}
+		if _, ok := comparisons[st.args[1]]; !ok {
+			return st, fmt.Errorf("unknown comparison %q", st.args[1])
+		}
+	default:
+		return st, fmt.Errorf("unknown action %q", st.action)
+	}
+	return st, nil
+}
+
+var comparisons = map[string]func(a, b int) bool{
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+	">":  func(a, b int) bool { return a > b },
+	"<":  func(a, b int) bool { return a < b },
+}
+
+type scenarioRun struct {
+	alice, bob *Entity
+	held       map[string]Msg
+	rids       map[string]int
+	transcript []string
+}
+
+func (r *scenarioRun) entities(who string) (us, them *Entity) {
+	if who == "A" {
+		return r.alice, r.bob
+	}
+	return r.bob, r.alice
+}
+
+// do runs a single step. A step fails if it panics, or if the receiver could
+// not read the message.
+func (r *scenarioRun) do(st step) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	us, them := r.entities(st.who)
+	switch st.action {
+	case "receive":
+		m, ok := r.held[st.args[0]]
+		if !ok {
+			return fmt.Errorf("no held message %q", st.args[0])
+		}
+		delete(r.held, st.args[0])
+		return receiveStep(us, m)
+	case "rid":
+		r.rids[st.hold] = us.currentRid()
+	case "expect":
+		want, ok := r.rids[st.args[2]]
+		if !ok {
+			return fmt.Errorf("no remembered rid %q", st.args[2])
+		}
+		if got := us.currentRid(); !comparisons[st.args[1]](got, want) {
+			return fmt.Errorf("rid is %d, expected %s %d", got, st.args[1], want)
+		}
+	default:
+		m := scenarioSends[st.action](us)
+		r.transcript = append(r.transcript, m.transcript())
+		if st.hold != "" {
+			r.held[st.hold] = m
+		} else {
+			return receiveStep(them, m)
+		}
+	}
+	return nil
+}
+
+// receiveStep hands m to e, and fails if e could not read it.
+func receiveStep(e *Entity, m Msg) error {
+	orig := e.tracer
+	rec := &recordTracer{}
+	if orig == nil {
+		e.tracer = multiTracer{defaultTracer, rec}
+	} else {
+		e.tracer = multiTracer{orig, rec}
+	}
+	defer func() { e.tracer = orig }()
+
+	e.receive(m)
+	for _, ev := range rec.events {
+		switch ev.kind {
+		case EVENT_DECRYPT_FAIL:
+			return fmt.Errorf("%s failed to decrypt the message", e.name)
+		case EVENT_REJECT:
+			return fmt.Errorf("%s rejected the message: %s", e.name, ev.note)
+		}
+	}
+	return nil
+}
+
+// newScenarioRun sets up the entities of a run. With a seed they are
+// reproducible, and so is the transcript.
+func newScenarioRun(seed []byte) *scenarioRun {
+	r := &scenarioRun{
+		held: make(map[string]Msg),
+		rids: make(map[string]int),
+	}
+	if seed != nil {
+		r.alice, r.bob = initializeSeeded(seed)
+	} else {
+		r.alice, r.bob = initialize()
+	}
+	return r
+}
+
+// run executes the scenario and returns the first failing step, if any.
+func (s *scenario) run(seed []byte) (r *scenarioRun, failed *step, err error) {
+	r = newScenarioRun(seed)
+	failed, err = s.runIn(r)
+	return
+}
+
+func (s *scenario) runIn(r *scenarioRun) (failed *step, err error) {
+	for i := range s.steps {
+		if err := r.do(s.steps[i]); err != nil {
+			return &s.steps[i], err
+		}
+	}
+	return nil, nil
+}
+
+func runScenarios(args []string) {
+	fs := flag.NewFlagSet("scenario", flag.ExitOnError)
+	seed := fs.String("seed", "", "run reproducibly from this seed, always over X448 as ed448 keys can not be seeded")
+	transcriptFile := fs.String("transcript", "", "write every message sent, keys included, to this file")
+	count := fs.Bool("count", false, "report the crypto operations of each entity")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+		exit(2)
+	}
+
+	var transcript io.Writer = io.Discard
+	if *transcriptFile != "" {
+		f, err := os.Create(*transcriptFile)
+		if err != nil {
+			fail(err)
+		}
+		defer f.Close()
+		transcript = f
+	}
+
+	failures := 0
+	for _, file := range fs.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			fail(err)
+		}
+		s, err := parseScenario(file, f)
+		f.Close()
+		if err != nil {
+			fail(err)
+		}
+
+		fmt.Printf("=== RUN %s\n", s.name)
+		var r *scenarioRun
+		if *seed != "" {
+			r = newScenarioRun([]byte(*seed))
+		} else {
+			r = newScenarioRun(nil)
+		}
+		var alice, bob *countingProvider
+		if *count {
+			alice, bob = newCountingProvider(r.alice.provider()), newCountingProvider(r.bob.provider())
+			r.alice.crypto, r.bob.crypto = alice, bob
+		}
+		st, err := s.runIn(r)
+
+		fmt.Fprintf(transcript, "# %s\n", s.name)
+		for _, line := range r.transcript {
+			fmt.Fprintln(transcript, line)
+		}
+
+		switch {
+		case err != nil && s.expectedToFail():
+			fmt.Printf("--- XFAIL %s:%d: %s: %s\n", s.name, st.line, st.text, err)
+		case err != nil:
+			failures++
+			fmt.Printf("--- FAIL %s:%d: %s: %s\n", s.name, st.line, st.text, err)
+		case s.expectedToFail():
+			failures++
+			fmt.Printf("--- XPASS %s: expected to fail in %s\n", s.name, designName)
+		default:
+			fmt.Printf("--- PASS %s\n", s.name)
+		}
+		if *count {
+			fmt.Printf("    %s: %s\n", r.alice.name, alice)
+			fmt.Printf("    %s: %s\n", r.bob.name, bob)
+		}
+	}
+
+	if failures > 0 {
+		fmt.Printf("FAIL %d of %d scenarios\n", failures, fs.NArg())
+		exit(1)
+	}
+	fmt.Println("PASS")
+}
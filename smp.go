@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// The Socialist Millionaires' Protocol of OTRv3, in the 3072-bit group of
+// dh3072.go. Both users learn whether they typed the same secret and nothing
+// else. It takes four messages, each of them a TLV in a data message.
+
+type smpState int
+
+const (
+	SMPSTATE_EXPECT1       smpState = iota
+	SMPSTATE_EXPECT_SECRET          // got SMP1, the user has to answer
+	SMPSTATE_EXPECT2
+	SMPSTATE_EXPECT3
+	SMPSTATE_EXPECT4
+)
+
+var smpStateNames = []string{
+	SMPSTATE_EXPECT1:       "EXPECT1",
+	SMPSTATE_EXPECT_SECRET: "EXPECT_SECRET",
+	SMPSTATE_EXPECT2:       "EXPECT2",
+	SMPSTATE_EXPECT3:       "EXPECT3",
+	SMPSTATE_EXPECT4:       "EXPECT4",
+}
+
+type smpResult int
+
+const (
+	SMP_NONE smpResult = iota
+	SMP_SUCCEEDED
+	SMP_FAILED
+	SMP_ABORTED
+)
+
+var smpResultNames = []string{
+	SMP_NONE:      "NONE",
+	SMP_SUCCEEDED: "SUCCEEDED",
+	SMP_FAILED:    "FAILED",
+	SMP_ABORTED:   "ABORTED",
+}
+
+var (
+	errSMPMalformed = errors.New("malformed SMP message")
+	errSMPProof     = errors.New("bad SMP proof")
+	errSMPState     = errors.New("unexpected SMP message")
+)
+
+// smp is one run of the protocol, from either side. The exponents and
+// values are ours or theirs: which of them are Alice's depends on initiator.
+type smp struct {
+	state    smpState
+	result   smpResult // of the last run
+	question string
+	ssid     int // of the session the run is bound to
+
+	initiator        bool
+	x                *big.Int // the secret
+	ourExp2, ourExp3 *big.Int
+	their2, their3   *big.Int // their g2 and g3 halves
+	g2, g3           *big.Int
+	ourP, ourQ       *big.Int
+	theirP, theirQ   *big.Int
+}
+
+var smpG1 = dh3072G
+
+// smpSecret binds what the user typed to both identities and to the session:
+//
+//	x = SHA-256(0x01 || initiator || responder || session id || secret)
+//
+// where the identities are identity keys, or DSA fingerprints in OTRv3.
+func smpSecret(initiator, responder, sessionID, secret []byte) *big.Int {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(initiator)
+	h.Write(responder)
+	h.Write(sessionID)
+	h.Write(secret)
+	return new(big.Int).SetBytes(h.Sum(nil))
+}
+
+func smpExponent(r io.Reader) *big.Int {
+	b := make([]byte, 80)
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic("failed to generate SMP exponent.")
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(b), dh3072Q)
+}
+
+func smpExp(b, e *big.Int) *big.Int {
+	return new(big.Int).Exp(b, e, dh3072P)
+}
+
+func smpMul(a, b *big.Int) *big.Int {
+	return new(big.Int).Mod(new(big.Int).Mul(a, b), dh3072P)
+}
+
+func smpDiv(a, b *big.Int) *big.Int {
+	return smpMul(a, new(big.Int).ModInverse(b, dh3072P))
+}
+
+// smpD is r - a*c mod q, the answer of a proof.
+func smpD(r, a, c *big.Int) *big.Int {
+	d := new(big.Int).Sub(r, new(big.Int).Mul(a, c))
+	return d.Mod(d, dh3072Q)
+}
+
+// smpHash is SHA-256(version || a || b), with b optional.
+func smpHash(version byte, a, b *big.Int) *big.Int {
+	var mpis []*big.Int
+	mpis = append(mpis, a)
+	if b != nil {
+		mpis = append(mpis, b)
+	}
+	h := sha256.Sum256(append([]byte{version}, encodeMPIs(mpis...)...))
+	return new(big.Int).SetBytes(h[:])
+}
+
+// encodeMPIs writes a count and then each value with its length, both 32
+// bits big endian.
+func encodeMPIs(mpis ...*big.Int) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint32(len(mpis)))
+	for _, n := range mpis {
+		writeBytes(b, n.Bytes())
+	}
+	return b.Bytes()
+}
+
+func decodeMPIs(b []byte, count int) ([]*big.Int, error) {
+	if len(b) < 4 || binary.BigEndian.Uint32(b) != uint32(count) {
+		return nil, errSMPMalformed
+	}
+	b = b[4:]
+
+	mpis := make([]*big.Int, count)
+	for i := range mpis {
+		if len(b) < 4 {
+			return nil, errSMPMalformed
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b[4:])) < n {
+			return nil, errSMPMalformed
+		}
+		mpis[i] = new(big.Int).SetBytes(b[4 : 4+n])
+		b = b[4+n:]
+	}
+	if len(b) != 0 {
+		return nil, errSMPMalformed
+	}
+	return mpis, nil
+}
+
+func smpCheckGroup(ns ...*big.Int) error {
+	for _, n := range ns {
+		if dh3072Check(n) != nil {
+			return errSMPMalformed
+		}
+	}
+	return nil
+}
+
+func smpCheckExponents(ns ...*big.Int) error {
+	for _, n := range ns {
+		if n.Cmp(dh3072Q) >= 0 {
+			return errSMPMalformed
+		}
+	}
+	return nil
+}
+
+// proveLog proves we know the exponent a of g1^a.
+func proveLog(r io.Reader, version byte, a *big.Int) (c, d *big.Int) {
+	k := smpExponent(r)
+	c = smpHash(version, smpExp(smpG1, k), nil)
+	return c, smpD(k, a, c)
+}
+
+func verifyLog(version byte, ga, c, d *big.Int) bool {
+	return c.Cmp(smpHash(version, smpMul(smpExp(smpG1, d), smpExp(ga, c)), nil)) == 0
+}
+
+func (s *smp) reset() {
+	*s = smp{result: s.result}
+}
+
+func (s *smp) abort() {
+	s.reset()
+	s.result = SMP_ABORTED
+}
+
+// start makes SMP1, or SMP1Q when there is a question.
+func (s *smp) start(r io.Reader, x *big.Int, question string, ssid int) tlv {
+	*s = smp{state: SMPSTATE_EXPECT2, ssid: ssid, initiator: true, x: x, question: question}
+	s.ourExp2, s.ourExp3 = smpExponent(r), smpExponent(r)
+
+	g2a, g3a := smpExp(smpG1, s.ourExp2), smpExp(smpG1, s.ourExp3)
+	c2, d2 := proveLog(r, 1, s.ourExp2)
+	c3, d3 := proveLog(r, 2, s.ourExp3)
+	msg := encodeMPIs(g2a, c2, d2, g3a, c3, d3)
+
+	if question != "" {
+		return tlv{TLV_SMP1Q, append(append([]byte(question), 0), msg...)}
+	}
+	return tlv{TLV_SMP1, msg}
+}
+
+func (s *smp) receive1(t tlv, ssid int) error {
+	msg := t.value
+	question := ""
+	if t.typ == TLV_SMP1Q {
+		i := bytes.IndexByte(msg, 0)
+		if i < 0 {
+			return errSMPMalformed
+		}
+		question, msg = string(msg[:i]), msg[i+1:]
+	}
+
+	v, err := decodeMPIs(msg, 6)
+	if err != nil {
+		return err
+	}
+	g2a, c2, d2, g3a, c3, d3 := v[0], v[1], v[2], v[3], v[4], v[5]
+	if err := smpCheckGroup(g2a, g3a); err != nil {
+		return err
+	}
+	if err := smpCheckExponents(d2, d3); err != nil {
+		return err
+	}
+	if !verifyLog(1, g2a, c2, d2) || !verifyLog(2, g3a, c3, d3) {
+		return errSMPProof
+	}
+
+	*s = smp{state: SMPSTATE_EXPECT_SECRET, ssid: ssid, question: question, their2: g2a, their3: g3a}
+	return nil
+}
+
+// answer makes SMP2 once the user gave us the secret.
+func (s *smp) answer(r io.Reader, y *big.Int) tlv {
+	s.x = y
+	s.ourExp2, s.ourExp3 = smpExponent(r), smpExponent(r)
+
+	g2b, g3b := smpExp(smpG1, s.ourExp2), smpExp(smpG1, s.ourExp3)
+	c2, d2 := proveLog(r, 3, s.ourExp2)
+	c3, d3 := proveLog(r, 4, s.ourExp3)
+
+	s.g2, s.g3 = smpExp(s.their2, s.ourExp2), smpExp(s.their3, s.ourExp3)
+
+	r4, r5, r6 := smpExponent(r), smpExponent(r), smpExponent(r)
+	s.ourP = smpExp(s.g3, r4)
+	s.ourQ = smpMul(smpExp(smpG1, r4), smpExp(s.g2, y))
+	cP := smpHash(5, smpExp(s.g3, r5), smpMul(smpExp(smpG1, r5), smpExp(s.g2, r6)))
+	d5, d6 := smpD(r5, r4, cP), smpD(r6, y, cP)
+
+	s.state = SMPSTATE_EXPECT3
+	return tlv{TLV_SMP2, encodeMPIs(g2b, c2, d2, g3b, c3, d3, s.ourP, s.ourQ, cP, d5, d6)}
+}
+
+// verifyPQ checks the proof that P and Q were made with the same exponent
+// and Q with the secret.
+func (s *smp) verifyPQ(version byte, p, q, cP, d5, d6 *big.Int) bool {
+	return cP.Cmp(smpHash(version,
+		smpMul(smpExp(s.g3, d5), smpExp(p, cP)),
+		smpMul(smpMul(smpExp(smpG1, d5), smpExp(s.g2, d6)), smpExp(q, cP)),
+	)) == 0
+}
+
+// qRatio is Qa/Qb and pRatio is Pa/Pb, whichever side we are.
+func (s *smp) qRatio() *big.Int {
+	if s.initiator {
+		return smpDiv(s.ourQ, s.theirQ)
+	}
+	return smpDiv(s.theirQ, s.ourQ)
+}
+
+func (s *smp) pRatio() *big.Int {
+	if s.initiator {
+		return smpDiv(s.ourP, s.theirP)
+	}
+	return smpDiv(s.theirP, s.ourP)
+}
+
+// proveR proves R = (Qa/Qb)^exp3, with g3 half g1^exp3.
+func (s *smp) proveR(r io.Reader, version byte) (R, c, d *big.Int) {
+	r7 := smpExponent(r)
+	R = smpExp(s.qRatio(), s.ourExp3)
+	c = smpHash(version, smpExp(smpG1, r7), smpExp(s.qRatio(), r7))
+	return R, c, smpD(r7, s.ourExp3, c)
+}
+
+func (s *smp) verifyR(version byte, R, c, d *big.Int) bool {
+	return c.Cmp(smpHash(version,
+		smpMul(smpExp(smpG1, d), smpExp(s.their3, c)),
+		smpMul(smpExp(s.qRatio(), d), smpExp(R, c)),
+	)) == 0
+}
+
+func (s *smp) receive2(r io.Reader, t tlv) (tlv, error) {
+	v, err := decodeMPIs(t.value, 11)
+	if err != nil {
+		return tlv{}, err
+	}
+	g2b, c2, d2, g3b, c3, d3, pb, qb, cP, d5, d6 := v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7], v[8], v[9], v[10]
+	if err := smpCheckGroup(g2b, g3b, pb, qb); err != nil {
+		return tlv{}, err
+	}
+	if err := smpCheckExponents(d2, d3, d5, d6); err != nil {
+		return tlv{}, err
+	}
+	if !verifyLog(3, g2b, c2, d2) || !verifyLog(4, g3b, c3, d3) {
+		return tlv{}, errSMPProof
+	}
+
+	s.their2, s.their3 = g2b, g3b
+	s.g2, s.g3 = smpExp(g2b, s.ourExp2), smpExp(g3b, s.ourExp3)
+	if !s.verifyPQ(5, pb, qb, cP, d5, d6) {
+		return tlv{}, errSMPProof
+	}
+	s.theirP, s.theirQ = pb, qb
+
+	r4, r5, r6 := smpExponent(r), smpExponent(r), smpExponent(r)
+	s.ourP = smpExp(s.g3, r4)
+	s.ourQ = smpMul(smpExp(smpG1, r4), smpExp(s.g2, s.x))
+	cP = smpHash(6, smpExp(s.g3, r5), smpMul(smpExp(smpG1, r5), smpExp(s.g2, r6)))
+	d5, d6 = smpD(r5, r4, cP), smpD(r6, s.x, cP)
+	ra, cR, d7 := s.proveR(r, 7)
+
+	s.state = SMPSTATE_EXPECT4
+	return tlv{TLV_SMP3, encodeMPIs(s.ourP, s.ourQ, cP, d5, d6, ra, cR, d7)}, nil
+}
+
+func (s *smp) receive3(r io.Reader, t tlv) (tlv, error) {
+	v, err := decodeMPIs(t.value, 8)
+	if err != nil {
+		return tlv{}, err
+	}
+	pa, qa, cP, d5, d6, ra, cR, d7 := v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7]
+	if err := smpCheckGroup(pa, qa, ra); err != nil {
+		return tlv{}, err
+	}
+	if err := smpCheckExponents(d5, d6, d7); err != nil {
+		return tlv{}, err
+	}
+	if !s.verifyPQ(6, pa, qa, cP, d5, d6) {
+		return tlv{}, errSMPProof
+	}
+	s.theirP, s.theirQ = pa, qa
+	if !s.verifyR(7, ra, cR, d7) {
+		return tlv{}, errSMPProof
+	}
+
+	rb, cR, d7 := s.proveR(r, 8)
+	s.finish(smpExp(ra, s.ourExp3))
+	return tlv{TLV_SMP4, encodeMPIs(rb, cR, d7)}, nil
+}
+
+func (s *smp) receive4(t tlv) error {
+	v, err := decodeMPIs(t.value, 3)
+	if err != nil {
+		return err
+	}
+	rb, cR, d7 := v[0], v[1], v[2]
+	if err := smpCheckGroup(rb); err != nil {
+		return err
+	}
+	if err := smpCheckExponents(d7); err != nil {
+		return err
+	}
+	if !s.verifyR(8, rb, cR, d7) {
+		return errSMPProof
+	}
+
+	s.finish(smpExp(rb, s.ourExp3))
+	return nil
+}
+
+// finish compares Rab with Pa/Pb: they are equal when the secrets are.
+func (s *smp) finish(rab *big.Int) {
+	result := SMP_FAILED
+	if rab.Cmp(s.pRatio()) == 0 {
+		result = SMP_SUCCEEDED
+	}
+	s.reset()
+	s.result = result
+}
+
+// receive runs an SMP TLV which came in the session ssid. It returns the
+// TLV to reply with, if any. Anything unexpected aborts the run, and the
+// peer is told so.
+func (s *smp) receive(r io.Reader, t tlv, ssid int) (reply *tlv, err error) {
+	abort := &tlv{TLV_SMP_ABORT, nil}
+
+	if t.typ == TLV_SMP_ABORT {
+		s.abort()
+		return nil, nil
+	}
+	if s.state != SMPSTATE_EXPECT1 && ssid != s.ssid {
+		s.abort()
+		return abort, errSMPState
+	}
+
+	switch {
+	case (t.typ == TLV_SMP1 || t.typ == TLV_SMP1Q) && s.state == SMPSTATE_EXPECT1:
+		err = s.receive1(t, ssid)
+	case t.typ == TLV_SMP2 && s.state == SMPSTATE_EXPECT2:
+		var next tlv
+		if next, err = s.receive2(r, t); err == nil {
+			reply = &next
+		}
+	case t.typ == TLV_SMP3 && s.state == SMPSTATE_EXPECT3:
+		var next tlv
+		if next, err = s.receive3(r, t); err == nil {
+			reply = &next
+		}
+	case t.typ == TLV_SMP4 && s.state == SMPSTATE_EXPECT4:
+		err = s.receive4(t)
+	default:
+		err = errSMPState
+	}
+
+	if err != nil {
+		s.abort()
+		return abort, err
+	}
+	return reply, nil
+}
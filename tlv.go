@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A tlv is a typed record in the plaintext of a data message.
+type tlv struct {
+	typ   uint16
+	value []byte
+}
+
+const (
+	TLV_PADDING      uint16 = 0
+	TLV_DISCONNECTED uint16 = 1
+	TLV_SMP1         uint16 = 2
+	TLV_SMP2         uint16 = 3
+	TLV_SMP3         uint16 = 4
+	TLV_SMP4         uint16 = 5
+	TLV_SMP_ABORT    uint16 = 6
+	TLV_SMP1Q        uint16 = 7 // SMP1 with a question
+	TLV_EXTRA_KEY    uint16 = 8 // extra symmetric key
+	TLV_RETRANSMIT   uint16 = 9 // asks for data messages we could not read
+
+	// types from here on are for applications to register
+	TLV_CUSTOM uint16 = 0x100
+)
+
+var (
+	errMalformedTLV = errors.New("malformed TLV")
+	errTLVTooLong   = errors.New("TLV value too long")
+)
+
+// fits tells whether the length of the value of t fits in its encoding.
+func (t tlv) fits() bool {
+	return len(t.value) <= 0xffff
+}
+
+// A tlvHandler gets the TLVs of its type from data messages we decrypted.
+// An error rejects the TLV.
+type tlvHandler func(t tlv) error
+
+// tlvRegistry maps application TLV types to their handlers. TLVs of types
+// nobody registered are ignored.
+type tlvRegistry map[uint16]tlvHandler
+
+func (r *tlvRegistry) register(typ uint16, h tlvHandler) {
+	if typ < TLV_CUSTOM {
+		panic("TLV type is reserved.")
+	}
+	if *r == nil {
+		*r = make(tlvRegistry)
+	}
+	if _, ok := (*r)[typ]; ok {
+		panic("TLV type is already registered.")
+	}
+	(*r)[typ] = h
+}
+
+func (r tlvRegistry) dispatch(t tlv) error {
+	h, ok := r[t.typ]
+	if !ok {
+		return nil
+	}
+	return h(t)
+}
+
+// extraKeyTLV asks the peer to use the extra symmetric key of the data
+// message it is in. usage and context are for the application to know what
+// the key is for, like a file transfer of a file named context.
+func extraKeyTLV(usage uint32, context []byte) tlv {
+	value := make([]byte, 4, 4+len(context))
+	binary.BigEndian.PutUint32(value, usage)
+	return tlv{TLV_EXTRA_KEY, append(value, context...)}
+}
+
+func parseExtraKeyTLV(t tlv) (usage uint32, context []byte, err error) {
+	if len(t.value) < 4 {
+		return 0, nil, errMalformedTLV
+	}
+	return binary.BigEndian.Uint32(t.value), t.value[4:], nil
+}
+
+// retransmitTLV asks the peer to send again what it sent in the last n data
+// messages before the current session.
+func retransmitTLV(n int) tlv {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, uint16(n))
+	return tlv{TLV_RETRANSMIT, value}
+}
+
+func parseRetransmitTLV(t tlv) (int, error) {
+	if len(t.value) != 2 {
+		return 0, errMalformedTLV
+	}
+	return int(binary.BigEndian.Uint16(t.value)), nil
+}
+
+// padTLVs adds a padding TLV so that the encoding of tlvs takes a multiple
+// of block bytes.
+func padTLVs(tlvs []tlv, block int) []tlv {
+	if block <= 0 {
+		return tlvs
+	}
+	n := 4
+	for _, t := range tlvs {
+		n += 4 + len(t.value)
+	}
+	return append(tlvs, tlv{TLV_PADDING, make([]byte, (block-n%block)%block)})
+}
+
+// encodeTLVs writes each record as type and length, both 16 bits big
+// endian, followed by the value.
+func encodeTLVs(tlvs []tlv) ([]byte, error) {
+	b := new(bytes.Buffer)
+	for _, t := range tlvs {
+		if !t.fits() {
+			return nil, errTLVTooLong
+		}
+		binary.Write(b, binary.BigEndian, t.typ)
+		binary.Write(b, binary.BigEndian, uint16(len(t.value)))
+		b.Write(t.value)
+	}
+	return b.Bytes(), nil
+}
+
+func decodeTLVs(b []byte) ([]tlv, error) {
+	var tlvs []tlv
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errMalformedTLV
+		}
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b[4:]) < n {
+			return nil, errMalformedTLV
+		}
+		tlvs = append(tlvs, tlv{typ, b[4 : 4+n]})
+		b = b[4+n:]
+	}
+	return tlvs, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+type eventType int
+
+const (
+	EVENT_SEND eventType = iota
+	EVENT_RECEIVE
+	EVENT_RATCHET
+	EVENT_FOLLOW_RATCHET
+	EVENT_AUTHSTATE
+	EVENT_KEYCHAIN_SWITCH
+	EVENT_DECRYPT_OK
+	EVENT_DECRYPT_FAIL
+	EVENT_NOTE
+	EVENT_REJECT
+)
+
+var eventNames = []string{
+	EVENT_SEND:            "send",
+	EVENT_RECEIVE:         "receive",
+	EVENT_RATCHET:         "ratchet",
+	EVENT_FOLLOW_RATCHET:  "follow-ratchet",
+	EVENT_AUTHSTATE:       "authstate",
+	EVENT_KEYCHAIN_SWITCH: "keychain-switch",
+	EVENT_DECRYPT_OK:      "decrypt-ok",
+	EVENT_DECRYPT_FAIL:    "decrypt-fail",
+	EVENT_NOTE:            "note",
+	EVENT_REJECT:          "reject",
+}
+
+var authStateNames = []string{
+	AUTHSTATE_NONE:              "NONE",
+	AUTHSTATE_AWAITING_DRE_AUTH: "AWAITING_DRE_AUTH",
+}
+
+// An event is what an Entity reports to its tracer. It only carries
+// metadata: keys never leave the Entity through a trace.
+type event struct {
+	kind   eventType
+	entity string
+
+	// mtype and sender are only meaningful for EVENT_SEND and EVENT_RECEIVE
+	mtype  int
+	sender string
+
+	rid, mid, ssid int
+	AuthState
+	note string
+}
+
+func (ev event) hasMsg() bool {
+	return ev.kind == EVENT_SEND || ev.kind == EVENT_RECEIVE
+}
+
+type tracer interface {
+	trace(ev event)
+}
+
+// defaultTracer is used by every Entity which has not been given its own.
+var defaultTracer tracer = logTracer{os.Stdout}
+
+// logTracer prints events for humans reading a run.
+type logTracer struct {
+	w io.Writer
+}
+
+func (t logTracer) trace(ev event) {
+	switch ev.kind {
+	case EVENT_RECEIVE, EVENT_RATCHET:
+		fmt.Fprintln(t.w)
+	}
+
+	switch ev.kind {
+	case EVENT_SEND, EVENT_RECEIVE:
+		fmt.Fprintf(t.w, "%s \t%s %s %d %d %d\n", ev.entity, eventNames[ev.kind], msgTypeNames[ev.mtype], ev.ssid, ev.rid, ev.mid)
+	case EVENT_AUTHSTATE:
+		fmt.Fprintf(t.w, "%s \tauthstate %s\n", ev.entity, authStateNames[ev.AuthState])
+	case EVENT_NOTE:
+		fmt.Fprintf(t.w, "%s \t - %s\n", ev.entity, ev.note)
+	case EVENT_REJECT:
+		fmt.Fprintf(t.w, "%s \treject: %s\n", ev.entity, ev.note)
+	default:
+		fmt.Fprintf(t.w, "%s \t%s %d %d %d\n", ev.entity, eventNames[ev.kind], ev.ssid, ev.rid, ev.mid)
+	}
+}
+
+// jsonEvent is the serialized form of an event, one per line.
+type jsonEvent struct {
+	Event     string `json:"event"`
+	Entity    string `json:"entity"`
+	Msg       string `json:"msg,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	Ssid      int    `json:"ssid"`
+	Rid       int    `json:"rid"`
+	Mid       int    `json:"mid"`
+	AuthState string `json:"authstate"`
+	Note      string `json:"note,omitempty"`
+}
+
+// jsonTracer writes events as JSON lines for analysis tooling.
+type jsonTracer struct {
+	w io.Writer
+}
+
+func (t jsonTracer) trace(ev event) {
+	j := jsonEvent{
+		Event:     eventNames[ev.kind],
+		Entity:    ev.entity,
+		Ssid:      ev.ssid,
+		Rid:       ev.rid,
+		Mid:       ev.mid,
+		AuthState: authStateNames[ev.AuthState],
+		Note:      ev.note,
+	}
+	if ev.hasMsg() {
+		j.Msg = msgTypeNames[ev.mtype]
+		j.Sender = ev.sender
+	}
+
+	line, err := json.Marshal(j)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(t.w, "%s\n", line)
+}
+
+// multiTracer hands every event to all its tracers.
+type multiTracer []tracer
+
+func (t multiTracer) trace(ev event) {
+	for _, each := range t {
+		each.trace(ev)
+	}
+}
+
+// recordTracer keeps every event in memory, in order.
+type recordTracer struct {
+	events []event
+}
+
+func (t *recordTracer) trace(ev event) {
+	t.events = append(t.events, ev)
+}
+
+func lookupName(names []string, name string) (int, error) {
+	for i, n := range names {
+		if n == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown name in trace: %q", name)
+}
+
+// readTrace parses the JSON lines written by a jsonTracer.
+func readTrace(r io.Reader) ([]event, error) {
+	var events []event
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var j jsonEvent
+		if err := dec.Decode(&j); err != nil {
+			return nil, err
+		}
+
+		ev := event{
+			entity: j.Entity,
+			sender: j.Sender,
+			rid:    j.Rid,
+			mid:    j.Mid,
+			ssid:   j.Ssid,
+			note:   j.Note,
+		}
+
+		kind, err := lookupName(eventNames, j.Event)
+		if err != nil {
+			return nil, err
+		}
+		ev.kind = eventType(kind)
+
+		state, err := lookupName(authStateNames, j.AuthState)
+		if err != nil {
+			return nil, err
+		}
+		ev.AuthState = AuthState(state)
+
+		if ev.hasMsg() {
+			if ev.mtype, err = lookupName(msgTypeNames, j.Msg); err != nil {
+				return nil, err
+			}
+		}
+
+		events = append(events, ev)
+	}
+	return events, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// vectorSeed is the seed of every transcript in the vectors directory.
+const vectorSeed = "otrv4 reference design vectors"
+
+var vectorMids = []int{0, 1, 2, 5, 10}
+
+type hexKey key
+
+func (k hexKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(k))
+}
+
+func (k *hexKey) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dec, err := hex.DecodeString(s)
+	*k = dec
+	return err
+}
+
+type chainKeyEntry struct {
+	Mid int    `json:"mid"`
+	A   hexKey `json:"chain_key_a"`
+	B   hexKey `json:"chain_key_b"`
+}
+
+// A kdfVector is one call to derive, followed by retriveChainkey on both of
+// the new chains at several message ids.
+type kdfVector struct {
+	Secret    hexKey          `json:"secret"`
+	PrevRoot  hexKey          `json:"prev_root,omitempty"`
+	Root      hexKey          `json:"root"`
+	Ca        hexKey          `json:"ca"`
+	Cb        hexKey          `json:"cb"`
+	ChainKeys []chainKeyEntry `json:"chain_keys"`
+}
+
+// referenceDerive is the KDF every design implements in derive:
+//
+//	R  = SHAKE-256(secret || prevRoot || 0)
+//	Ca = SHAKE-256(secret || prevRoot || 1)
+//	Cb = SHAKE-256(secret || prevRoot || 2)
+//
+// with 64 bytes of output, and without prevRoot in the DAKE.
+func referenceDerive(secret, prevRoot key) (r, ca, cb key) {
+	r, ca, cb = make(key, 64), make(key, 64), make(key, 64)
+	in := append(append(key{}, secret...), prevRoot...)
+	sha3.ShakeSum256(r, append(in, 0))
+	sha3.ShakeSum256(ca, append(in, 1))
+	sha3.ShakeSum256(cb, append(in, 2))
+	return
+}
+
+// referenceChainKey hashes the chain key once per message id.
+func referenceChainKey(ck key, mid int) key {
+	buf := append(key{}, ck...)
+	for i := 0; i < mid; i++ {
+		sha3.ShakeSum256(buf, buf)
+	}
+	return buf
+}
+
+func vectorBytes(label string, i int) key {
+	out := make(key, 64)
+	sha3.ShakeSum256(out, []byte(fmt.Sprintf("%s %s %d", vectorSeed, label, i)))
+	return out
+}
+
+func generateKDFVectors() []kdfVector {
+	var vectors []kdfVector
+	for i := 0; i < 4; i++ {
+		v := kdfVector{Secret: hexKey(vectorBytes("secret", i))}
+		if i > 0 {
+			v.PrevRoot = hexKey(vectorBytes("root", i))
+		}
+
+		r, ca, cb := referenceDerive(key(v.Secret), key(v.PrevRoot))
+		v.Root, v.Ca, v.Cb = hexKey(r), hexKey(ca), hexKey(cb)
+		for _, mid := range vectorMids {
+			v.ChainKeys = append(v.ChainKeys, chainKeyEntry{
+				Mid: mid,
+				A:   hexKey(referenceChainKey(ca, mid)),
+				B:   hexKey(referenceChainKey(cb, mid)),
+			})
+		}
+		vectors = append(vectors, v)
+	}
+	return vectors
+}
+
+// checkKDFVector runs a vector against the derive and retriveChainkey of the
+// design.
+func checkKDFVector(v kdfVector) error {
+	var prevRoot key
+	if len(v.PrevRoot) > 0 {
+		prevRoot = key(v.PrevRoot)
+	}
+
+	r, ca, cb := deriveVector(key(v.Secret), prevRoot)
+	for _, c := range []struct {
+		name      string
+		got, want key
+	}{{"root", r, key(v.Root)}, {"ca", ca, key(v.Ca)}, {"cb", cb, key(v.Cb)}} {
+		if !bytes.Equal(c.got, c.want) {
+			return fmt.Errorf("%s is %x, expected %x", c.name, c.got, c.want)
+		}
+	}
+
+	for _, ck := range v.ChainKeys {
+		if got := chainKeyVector(ca, ck.Mid); !bytes.Equal(got, ck.A) {
+			return fmt.Errorf("chain key a at mid %d is %x, expected %x", ck.Mid, got, ck.A)
+		}
+		if got := chainKeyVector(cb, ck.Mid); !bytes.Equal(got, ck.B) {
+			return fmt.Errorf("chain key b at mid %d is %x, expected %x", ck.Mid, got, ck.B)
+		}
+	}
+	return nil
+}
+
+func transcriptFile(dir, scenarioFile string) string {
+	name := strings.TrimSuffix(filepath.Base(scenarioFile), filepath.Ext(scenarioFile))
+	return filepath.Join(dir, designName, name+".transcript")
+}
+
+func loadScenario(file string) *scenario {
+	f, err := os.Open(file)
+	if err != nil {
+		fail(err)
+	}
+	defer f.Close()
+
+	s, err := parseScenario(file, f)
+	if err != nil {
+		fail(err)
+	}
+	return s
+}
+
+func writeVectors(dir string, scenarios []string) {
+	kdf, err := json.MarshalIndent(generateKDFVectors(), "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kdf.json"), append(kdf, '\n'), 0644); err != nil {
+		fail(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, designName), 0755); err != nil {
+		fail(err)
+	}
+	for _, file := range scenarios {
+		r, st, err := loadScenario(file).run([]byte(vectorSeed))
+		if err != nil {
+			fmt.Printf("skipped %s: fails at line %d: %s\n", file, st.line, err)
+			continue
+		}
+
+		out := []byte(strings.Join(r.transcript, "\n") + "\n")
+		if err := os.WriteFile(transcriptFile(dir, file), out, 0644); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func verifyVectors(dir string, scenarios []string) (failures int) {
+	kdf, err := os.ReadFile(filepath.Join(dir, "kdf.json"))
+	if err != nil {
+		fail(err)
+	}
+	var vectors []kdfVector
+	if err := json.Unmarshal(kdf, &vectors); err != nil {
+		fail(err)
+	}
+
+	for i, v := range vectors {
+		if err := checkKDFVector(v); err != nil {
+			failures++
+			fmt.Printf("--- FAIL kdf.json vector %d: %s\n", i, err)
+		}
+	}
+
+	for _, file := range scenarios {
+		s := loadScenario(file)
+		want, err := os.ReadFile(transcriptFile(dir, file))
+		if os.IsNotExist(err) && s.expectedToFail() {
+			continue
+		}
+		if os.IsNotExist(err) {
+			failures++
+			fmt.Printf("--- FAIL %s: no transcript in %s\n", file, filepath.Join(dir, designName))
+			continue
+		}
+		if err != nil {
+			fail(err)
+		}
+
+		r, st, err := s.run([]byte(vectorSeed))
+		if err != nil {
+			failures++
+			fmt.Printf("--- FAIL %s: fails at line %d: %s\n", file, st.line, err)
+			continue
+		}
+
+		if got := strings.Join(r.transcript, "\n") + "\n"; got != string(want) {
+			failures++
+			fmt.Printf("--- FAIL %s: transcript differs from %s\n", file, transcriptFile(dir, file))
+		}
+	}
+	return
+}
+
+func runVectors(args []string) {
+	fs := flag.NewFlagSet("vectors", flag.ExitOnError)
+	generate := fs.Bool("generate", false, "write the vectors instead of checking them")
+	dir := fs.String("dir", "vectors", "directory of the vectors")
+	fs.Parse(args)
+
+	scenarios := fs.Args()
+	if len(scenarios) == 0 {
+		scenarios, _ = filepath.Glob(filepath.Join("scenarios", "*.scenario"))
+	}
+
+	if *generate {
+		writeVectors(*dir, scenarios)
+		return
+	}
+
+	if failures := verifyVectors(*dir, scenarios); failures > 0 {
+		fmt.Printf("FAIL %d vectors of %s\n", failures, designName)
+		exit(1)
+	}
+	fmt.Printf("PASS vectors of %s\n", designName)
+}